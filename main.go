@@ -1,23 +1,215 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bluemods/p0f-go/p0f"
 )
 
 func main() {
-	sockFile := flag.String("s", p0f.DefaultSock, fmt.Sprintf("p0f socket file, default is `%s`", p0f.DefaultSock))
-	port := flag.Int("p", p0f.DefaultPort, fmt.Sprintf("HTTP API port, default is %d", p0f.DefaultPort))
+	// Defaults may be set in the environment, flags override them
+	defaultPort, envPortErr := envPort()
+	sockFile := flag.String("s", envOr("P0F_SOCK", p0f.DefaultSock), fmt.Sprintf("p0f socket file, or @name for a Linux abstract socket, default is `%s` (also set by P0F_SOCK)", p0f.DefaultSock))
+	port := flag.Int("p", defaultPort, fmt.Sprintf("HTTP API port, default is %d (also set by P0F_PORT)", p0f.DefaultPort))
+	bind := flag.String("b", os.Getenv("P0F_ADDR"), "HTTP API bind address, such as `127.0.0.1`, default is all interfaces (also set by P0F_ADDR)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, serves HTTPS with -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM key file of -tls-cert")
+	testMode := flag.Bool("test", os.Getenv("P0F_TEST_MODE") == "1", "serve synthetic responses without p0f (also enabled by P0F_TEST_MODE=1)")
+	testRules := flag.String("test-rules", "", "JSON file mapping IP addresses to synthetic responses, implies -test")
+	queryIP := flag.String("q", "", "query p0f for IP address `ip`, print the response as JSON and exit instead of serving HTTP; - queries each line of stdin")
+	printVersion := flag.Bool("version", false, "print the version of this build and exit")
 	flag.Parse()
 
-	if len(*sockFile) == 0 {
+	if *printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	// An invalid P0F_PORT only matters when -p does not override it
+	if envPortErr != nil && !isFlagSet(flag.CommandLine, "p") {
+		log.Fatal(envPortErr)
+	}
+	if len(*sockFile) == 0 || *sockFile == "@" {
 		log.Fatal("-s is not a valid file name")
 	}
 	if *port < 0 || *port > 0xFFFF {
 		log.Fatalf("invalid port (%d)", *port)
 	}
-	log.Fatal(p0f.StartHttpWebServer(*sockFile, *port, p0f.DefaultIpResolver))
+	httpOpts := []p0f.HttpOption{p0f.WithBindAddress(*bind)}
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := p0f.LoadTLSConfig(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpOpts = append(httpOpts, p0f.WithTLS(config))
+	}
+	// Survive p0f restarts without restarting the server
+	opts := []p0f.Option{p0f.WithReconnect(100*time.Millisecond, 10*time.Second)}
+	if *testMode || *testRules != "" {
+		opt, err := syntheticOption(*testRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, opt)
+		log.Println("TEST MODE: serving synthetic responses, p0f is not queried")
+	}
+	p, err := p0f.New(*sockFile, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch *queryIP {
+	case "":
+	case "-":
+		os.Exit(queryLines(p, os.Stdin, os.Stdout))
+	default:
+		os.Exit(queryOnce(p, *queryIP, os.Stdout))
+	}
+	handleSignals(p)
+
+	// Finish the queries in progress on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = p0f.ServeHttpContext(ctx, p, *port, p0f.DefaultIpResolver, httpOpts...)
+	p.Shutdown()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns the environment variable name, or fallback if it is unset or empty.
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Returns the HTTP API port set by P0F_PORT, or p0f.DefaultPort if it is unset,
+// with an error if it is not a number.
+func envPort() (int, error) {
+	env := os.Getenv("P0F_PORT")
+	if env == "" {
+		return p0f.DefaultPort, nil
+	}
+	port, err := strconv.Atoi(env)
+	if err != nil {
+		return p0f.DefaultPort, fmt.Errorf("invalid P0F_PORT (%s)", env)
+	}
+	return port, nil
+}
+
+// Reports whether the flag name was set on the command line parsed by fs.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Queries p for ip and writes the response to w as JSON, for -q.
+// Returns the exit status: 0 for a match, 2 for no match and 1 for errors.
+func queryOnce(p *p0f.P0f, ip string, w io.Writer) int {
+	defer p.Shutdown()
+	response, err := p.QueryString(ip)
+	if errors.Is(err, p0f.ErrNoMatch) {
+		log.Printf("no match for %s", ip)
+		return 2
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// Queries in flight at once by queryLines, which bounds how many results are held
+// while waiting for an earlier one to be written
+const queryLinesParallelism = 64
+
+// Line written by queryLines for an address without a match or whose query failed
+type queryLineError struct {
+	Ip    string `json:"ip"`
+	Error string `json:"error"`
+}
+
+// Queries p for the address on each line of r, for -q -, writing one JSON line to w for each
+// in the order of r as results come in: the response, or {"ip": ..., "error": "no match"}
+// and the like for the others. Blank lines are skipped.
+// Returns the exit status, 1 if reading r or writing w failed and 0 otherwise.
+func queryLines(p *p0f.P0f, r io.Reader, w io.Writer) int {
+	defer p.Shutdown()
+	pending := make(chan chan any, queryLinesParallelism)
+	var readErr error
+	go func() {
+		defer close(pending)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			ip := strings.TrimSpace(scanner.Text())
+			if ip == "" {
+				continue
+			}
+			result := make(chan any, 1)
+			pending <- result
+			go func() {
+				response, err := p.QueryString(ip)
+				if err != nil {
+					result <- queryLineError{ip, err.Error()}
+					return
+				}
+				result <- response
+			}()
+		}
+		readErr = scanner.Err()
+	}()
+
+	status := 0
+	enc := json.NewEncoder(w)
+	for result := range pending {
+		if err := enc.Encode(<-result); err != nil && status == 0 {
+			log.Print(err)
+			status = 1
+		}
+	}
+	if readErr != nil {
+		log.Print(readErr)
+		status = 1
+	}
+	return status
+}
+
+// Returns the WithSynthetic option for the rule file at path,
+// or for hash based responses if path is empty.
+func syntheticOption(path string) (p0f.Option, error) {
+	if path == "" {
+		return p0f.WithSynthetic(nil), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := map[string]p0f.P0fResponse{}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("invalid test rules file: %w", err)
+	}
+	return p0f.WithSynthetic(rules), nil
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/bluemods/p0f-go/p0f"
+)
+
+func TestSyntheticOption(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	rules := write("rules.json", `{"192.0.2.1": {"osName": "Linux", "distance": 12}}`)
+
+	for _, test := range []struct {
+		path    string
+		wantErr bool
+	}{
+		{"", false},
+		{rules, false},
+		{write("invalid.json", `["192.0.2.1"]`), true},
+		{write("invalid-ip.json", `{"example.com": {}}`), true},
+		{filepath.Join(dir, "missing.json"), true},
+	} {
+		opt, err := syntheticOption(test.path)
+		if err == nil {
+			var p *p0f.P0f
+			if p, err = p0f.New("", opt); err == nil {
+				p.Shutdown()
+			}
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("syntheticOption(%q) error = %v, want an error %v", test.path, err, test.wantErr)
+		}
+	}
+
+	opt, err := syntheticOption(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := p0f.New("", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if r, err := p.Query(net.ParseIP("192.0.2.1")); err != nil || r.OsName == nil || *r.OsName != "Linux" || r.Distance != 12 {
+		t.Errorf("Query(192.0.2.1) = %+v, %v, want the rule of %s", r, err, rules)
+	}
+	if _, err := p.Query(net.ParseIP("192.0.2.2")); !errors.Is(err, p0f.ErrNoMatch) {
+		t.Errorf("Query(192.0.2.2) error = %v, want %v", err, p0f.ErrNoMatch)
+	}
+}
+
+func TestEnvPort(t *testing.T) {
+	for _, test := range []struct {
+		env     string
+		want    int
+		wantErr bool
+	}{
+		{"", p0f.DefaultPort, false},
+		{"8080", 8080, false},
+		{"http", p0f.DefaultPort, true},
+	} {
+		t.Setenv("P0F_PORT", test.env)
+		port, err := envPort()
+		if port != test.want || (err != nil) != test.wantErr {
+			t.Errorf("envPort() with P0F_PORT=%q = %d, %v, want %d and error %v", test.env, port, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestIsFlagSet(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"-s", "/tmp/p0f.sock"}, false},
+		{[]string{"-p", "8080"}, true},
+		{[]string{"-p=0"}, true},
+	} {
+		fs := flag.NewFlagSet("p0f-go", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.String("s", "", "")
+		fs.Int("p", p0f.DefaultPort, "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := isFlagSet(fs, "p"); got != test.want {
+			t.Errorf("isFlagSet(%q) = %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+// Discards what the tested code logs for the duration of the test.
+func silenceLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestQueryOnce(t *testing.T) {
+	silenceLog(t)
+	rules := map[string]p0f.P0fResponse{"192.0.2.1": {Distance: 12}}
+	for _, test := range []struct {
+		ip     string
+		status int
+	}{
+		{"192.0.2.1", 0},
+		{"192.0.2.2", 2},
+		{"192.0.2", 1},
+	} {
+		p, err := p0f.New("", p0f.WithSynthetic(rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if status := queryOnce(p, test.ip, &out); status != test.status {
+			t.Errorf("queryOnce(%q) = %d, want %d", test.ip, status, test.status)
+		}
+		if test.status != 0 {
+			if out.Len() != 0 {
+				t.Errorf("queryOnce(%q) wrote %q, want nothing", test.ip, out.String())
+			}
+			continue
+		}
+		var response p0f.P0fResponse
+		if err := json.Unmarshal(out.Bytes(), &response); err != nil {
+			t.Fatalf("queryOnce(%q) wrote %q: %v", test.ip, out.String(), err)
+		}
+		if response.Ip != test.ip || response.Distance != 12 {
+			t.Errorf("queryOnce(%q) wrote %+v, want the rule for %s", test.ip, response, test.ip)
+		}
+	}
+}
+
+func TestQueryLines(t *testing.T) {
+	silenceLog(t)
+	p, err := p0f.New("", p0f.WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More lines than queryLinesParallelism, so results written in order wait for later queries
+	var input strings.Builder
+	var want []string
+	for i := range 4 * queryLinesParallelism {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		switch i % 50 {
+		case 7:
+			input.WriteString("\n  \t\n")
+		case 13:
+			ip = "not-an-ip"
+		}
+		fmt.Fprintf(&input, " %s\n", ip)
+		want = append(want, ip)
+	}
+
+	var out bytes.Buffer
+	if status := queryLines(p, strings.NewReader(input.String()), &out); status != 0 {
+		t.Errorf("queryLines = %d, want 0", status)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("queryLines wrote %d lines, want %d", len(lines), len(want))
+	}
+	for i, text := range lines {
+		var line struct {
+			Ip    string
+			Error string
+		}
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatalf("line %d %q: %v", i, text, err)
+		}
+		if line.Ip != want[i] {
+			t.Fatalf("line %d is for %q, want %q", i, line.Ip, want[i])
+		}
+		if wantErr := want[i] == "not-an-ip"; (line.Error != "") != wantErr {
+			t.Errorf("line %d %q, want an error %v", i, text, wantErr)
+		}
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	t.Cleanup(func() { version, revision = "", "" })
+	info := &debug.BuildInfo{
+		Main: debug.Module{Path: "github.com/bluemods/p0f-go", Version: "v1.1.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "1a2b3c4"},
+			{Key: "vcs.time", Value: "2026-01-02T15:04:05Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	for _, test := range []struct {
+		version, revision string
+		info              *debug.BuildInfo
+		want              string
+	}{
+		{"", "", nil, "p0f-go (devel)"},
+		{"", "", info, "p0f-go v1.1.0 (revision 1a2b3c4-dirty, 2026-01-02T15:04:05Z)"},
+		{"", "", &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, "p0f-go (devel)"},
+		{"v1.2.0", "", info, "p0f-go v1.2.0 (revision 1a2b3c4-dirty, 2026-01-02T15:04:05Z)"},
+		{"v1.2.0", "5d6e7f8", info, "p0f-go v1.2.0 (revision 5d6e7f8)"},
+		{"v1.2.0", "5d6e7f8", nil, "p0f-go v1.2.0 (revision 5d6e7f8)"},
+	} {
+		version, revision = test.version, test.revision
+		want := test.want + " " + runtime.Version()
+		if got := formatVersion(test.info); got != want {
+			t.Errorf("formatVersion with version %q revision %q = %q, want %q", test.version, test.revision, got, want)
+		}
+	}
+}
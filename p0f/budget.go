@@ -0,0 +1,84 @@
+package p0f
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket holding up to burst tokens, refilled at rate tokens per second.
+// It starts full.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum number of tokens
+	tokens float64
+	last   time.Time // When tokens was last refilled
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Takes a token from the bucket, reporting whether one was available.
+// A nil bucket always has one.
+func (b *tokenBucket) allow() bool {
+	ok, _ := b.take()
+	return ok
+}
+
+// Same as allow, also returning how long until the next token is available when none is.
+func (b *tokenBucket) take() (ok bool, wait time.Duration) {
+	return b.takeN(1)
+}
+
+// Same as take, for n tokens at once. Either all n are taken or none.
+func (b *tokenBucket) takeN(n int) (ok bool, wait time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < float64(n) {
+		return false, time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens -= float64(n)
+	return true, 0
+}
+
+// Puts back n tokens taken with takeN, up to the burst.
+func (b *tokenBucket) putBack(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+float64(n))
+}
+
+// Reports whether n tokens can ever be taken at once, which is not the case over the burst.
+func (b *tokenBucket) holds(n int) bool {
+	return b == nil || float64(n) <= b.burst
+}
+
+// Reports whether a retry may be made, counting it in Stats either way.
+// With WithRetryBudget, every retry made on behalf of p draws from the same token bucket,
+// so that retries stay bounded when everything is failing at once.
+//
+// The retry sites drawing from it are:
+//   - Socket reads and writes retried after a temporary error, one token per retry.
+//   - The long-poll endpoint, one token for each repeated query after a no match.
+//     Once the budget is exhausted, the poll ends early with 204 No Content.
+//   - Reconnects after the connection was lost or found misaligned, one token for each
+//     attempt after the first. Without a token the attempt is skipped until the next backoff delay.
+func (p *P0f) allowRetry() bool {
+	if !p.retries.allow() {
+		p.stats.retriesDenied.Add(1)
+		return false
+	}
+	p.stats.retries.Add(1)
+	return true
+}
@@ -0,0 +1,130 @@
+package p0f
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LRU cache of responses keyed by IP string.
+//
+// Entries are fresh for ttl after being stored, and are kept
+// for an additional staleTTL so they can be served if p0f is unavailable.
+// No match results are cached for negativeTTL if it is positive, and never served stale.
+// Entries past both are evicted lazily on access.
+type cache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	staleTTL    time.Duration
+	negativeTTL time.Duration
+	max         int
+	entries     map[string]*list.Element
+	lru         *list.List // front is most recently used
+
+	hits   atomic.Uint64 // Lookups by get that found a fresh entry
+	misses atomic.Uint64 // Lookups by get that did not
+}
+
+type cacheEntry struct {
+	key      string
+	response P0fResponse
+	queried  time.Time // When p0f answered with response
+	expires  time.Time
+	noMatch  bool // p0f had no match, response is empty
+}
+
+func newCache(ttl, staleTTL, negativeTTL time.Duration, maxEntries int) *cache {
+	return &cache{
+		ttl:         ttl,
+		staleTTL:    staleTTL,
+		negativeTTL: negativeTTL,
+		max:         maxEntries,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// Returns the cached entry for key if it has not expired.
+// Entries with noMatch set stand for an ErrNoMatch result.
+func (c *cache) get(key string) (cacheEntry, bool) {
+	entry, ok := c.lookup(key, 0)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return entry, ok
+}
+
+// Returns the cached entry for key if it expired no longer than staleTTL ago.
+// No match entries are not returned, only matches are worth serving stale.
+func (c *cache) getStale(key string) (cacheEntry, bool) {
+	entry, ok := c.lookup(key, c.staleTTL)
+	return entry, ok && !entry.noMatch
+}
+
+func (c *cache) lookup(key string, grace time.Duration) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires.Add(c.staleTTL)) {
+		c.remove(elem)
+		return cacheEntry{}, false
+	}
+	if now.After(entry.expires.Add(grace)) {
+		return cacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return *entry, true
+}
+
+// Stores the result of a query for key: response if err is nil, or a no match entry
+// if err is ErrNoMatch and negativeTTL is positive. Other results are not stored.
+func (c *cache) store(key string, response P0fResponse, err error) {
+	switch {
+	case err == nil:
+		c.put(key, response, false)
+	case err == ErrNoMatch && c.negativeTTL > 0:
+		c.put(key, P0fResponse{}, true)
+	}
+}
+
+func (c *cache) put(key string, response P0fResponse, noMatch bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	expires := now.Add(c.ttl)
+	if noMatch {
+		expires = now.Add(c.negativeTTL)
+	}
+	entry := cacheEntry{key: key, response: response, queried: now, expires: expires, noMatch: noMatch}
+	if elem, ok := c.entries[key]; ok {
+		*elem.Value.(*cacheEntry) = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&entry)
+	if c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Returns the number of entries, including expired ones not evicted yet.
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,231 @@
+package p0f
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryStaleOnError(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	stop := serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile, WithCache(10*time.Millisecond, 10), WithStaleOnError(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	fresh, err := p.Query(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Stale {
+		t.Fatal("Stale = true for a response from p0f")
+	}
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	response, err := p.Query(ip)
+	if err != nil {
+		t.Fatalf("Query error = %v, want the stale response", err)
+	}
+	if !response.Stale || response.FirstSeen != fresh.FirstSeen {
+		t.Errorf("Query = %+v, want the expired response with Stale set", response)
+	}
+	if _, err := p.Query(net.ParseIP("192.0.2.2")); err == nil {
+		t.Error("Query of an uncached address succeeded while p0f is unavailable")
+	}
+	if got := p.Stats().Stale; got != 1 {
+		t.Errorf("Stats().Stale = %d, want 1", got)
+	}
+	if _, err := New(sockFile, WithStaleOnError(time.Hour)); err == nil {
+		t.Error("New() with WithStaleOnError and without WithCache succeeded")
+	}
+}
+
+func TestQueryFresh(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile, WithCache(time.Hour, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	wantQueries := func(want uint64) {
+		t.Helper()
+		if got := p.Stats().Queries; got != want {
+			t.Fatalf("%d queries sent to p0f, want %d", got, want)
+		}
+	}
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.QueryFresh(ip); err != nil {
+		t.Fatal(err)
+	}
+	wantQueries(2)
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	wantQueries(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.QueryFreshContext(ctx, ip); err != context.Canceled {
+		t.Fatalf("QueryFreshContext with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+
+	s := newTestServer(p)
+	for _, test := range []struct {
+		target      string
+		wantQueries uint64
+	}{
+		{"/", 2},
+		{"/?nocache=1", 3},
+		{"/?nocache", 4},
+		{"/", 4},
+	} {
+		w := httptest.NewRecorder()
+		s.serveQuery(w, httptest.NewRequest("GET", test.target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", test.target, w.Code, http.StatusOK)
+		}
+		wantQueries(test.wantQueries)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	ip := net.ParseIP("192.0.2.1")
+	if err := p.Touch(context.Background(), ip); err == nil {
+		t.Error("Touch without a cache succeeded")
+	}
+	if queries := p.Stats().Queries; queries != 0 {
+		t.Errorf("Touch without a cache sent %d queries, want 0", queries)
+	}
+
+	p, err = New(sockFile, WithCache(time.Hour, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Touch(ctx, ip); err != context.Canceled {
+		t.Fatalf("Touch with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+	for range 2 {
+		if err := p.Touch(context.Background(), ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := p.Stats(); stats.Queries != 2 || stats.CacheEntries != 1 {
+		t.Fatalf("Stats() = %+v after touching twice, want 2 queries and 1 cache entry", stats)
+	}
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Queries != 2 || stats.CacheHits != 1 {
+		t.Errorf("Stats() = %+v, want the query served from the touched entry", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(time.Hour, 0, 0, 2)
+	c.put("a", P0fResponse{Ip: "a"}, false)
+	c.put("b", P0fResponse{Ip: "b"}, false)
+	c.get("a") // b is now the least recently used
+	c.put("c", P0fResponse{Ip: "c"}, false)
+
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if entry, ok := c.get(key); !ok || entry.response.Ip != key {
+			t.Errorf("get(%q) = %q, %v, want a hit", key, entry.response.Ip, ok)
+		}
+	}
+	if got := c.len(); got != 2 {
+		t.Errorf("len() = %d, want 2", got)
+	}
+	if hits, misses := c.hits.Load(), c.misses.Load(); hits != 3 || misses != 1 {
+		t.Errorf("hits, misses = %d, %d, want 3, 1", hits, misses)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newCache(10*time.Millisecond, 20*time.Millisecond, 0, 10)
+	c.put("a", P0fResponse{}, false)
+	time.Sleep(15 * time.Millisecond)
+
+	if _, ok := c.get("a"); ok {
+		t.Error("expired entry returned by get")
+	}
+	if _, ok := c.getStale("a"); !ok {
+		t.Error("entry within staleTTL not returned by getStale")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.getStale("a"); ok {
+		t.Error("entry past staleTTL returned by getStale")
+	}
+	if got := c.len(); got != 0 {
+		t.Errorf("len() = %d after lazy eviction, want 0", got)
+	}
+}
+
+func TestQueryCacheNormalizedKey(t *testing.T) {
+	p, err := New("", WithSynthetic(nil), WithCache(time.Hour, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	if _, err := p.Query(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Query(net.ParseIP("::ffff:192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Queries != 1 || stats.CacheHits != 1 || stats.CacheEntries != 1 {
+		t.Errorf("Stats() = %+v, want the IPv4-mapped address served from the cache", stats)
+	}
+}
+
+func TestQueryNegativeCache(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{}), WithCache(time.Hour, 10), WithNegativeCache(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	ip := net.ParseIP("192.0.2.1")
+
+	for range 2 {
+		if _, err := p.Query(ip); err != ErrNoMatch {
+			t.Fatalf("Query() error = %v, want ErrNoMatch", err)
+		}
+	}
+	if stats := p.Stats(); stats.Queries != 1 || stats.CacheHits != 1 {
+		t.Errorf("Stats() = %+v, want the second no match served from the cache", stats)
+	}
+	time.Sleep(30 * time.Millisecond)
+	p.Query(ip)
+	if stats := p.Stats(); stats.Queries != 2 {
+		t.Errorf("Queries = %d after the negative ttl, want 2", stats.Queries)
+	}
+
+	if _, err := New("", WithSynthetic(nil), WithNegativeCache(0)); err == nil {
+		t.Error("New() with WithNegativeCache and without WithCache succeeded")
+	}
+}
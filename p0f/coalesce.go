@@ -0,0 +1,68 @@
+package p0f
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Shares the result of one p0f query between all callers asking for the same IP
+// while the query is in flight, and for window after it was started.
+type flightGroup struct {
+	mu      sync.Mutex
+	window  time.Duration
+	flights map[string]*flight
+}
+
+type flight struct {
+	done     chan struct{} // closed once response and err are set
+	response P0fResponse
+	err      error
+}
+
+func newFlightGroup(window time.Duration) *flightGroup {
+	return &flightGroup{window: window, flights: make(map[string]*flight)}
+}
+
+// Calls fn for key, unless a call for key has been started within the window,
+// in which case its result is waited for and returned instead.
+//
+// fn runs on its own goroutine, so a caller whose ctx is done returns ctx.Err() right away
+// without cancelling the call for the callers still waiting on it.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (P0fResponse, error)) (P0fResponse, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+		go g.run(key, f, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.response, f.err
+	case <-ctx.Done():
+		return P0fResponse{}, ctx.Err()
+	}
+}
+
+func (g *flightGroup) run(key string, f *flight, fn func() (P0fResponse, error)) {
+	started := time.Now()
+	f.response, f.err = fn()
+	close(f.done)
+
+	if remaining := g.window - time.Since(started); remaining > 0 {
+		time.AfterFunc(remaining, func() { g.forget(key, f) })
+	} else {
+		g.forget(key, f)
+	}
+}
+
+func (g *flightGroup) forget(key string, f *flight) {
+	g.mu.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.mu.Unlock()
+}
@@ -0,0 +1,58 @@
+package p0f
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueryCoalesceWindow(t *testing.T) {
+	const window = 200 * time.Millisecond
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile, WithCoalesceWindow(window))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	started := time.Now()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Query(ip); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Completed, but still within the window
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(started) >= window {
+		t.Skip("queries took longer than the coalesce window")
+	}
+	if queries := p.Stats().Queries; queries != 1 {
+		t.Fatalf("queries within the window sent %d requests to p0f, want 1", queries)
+	}
+	if _, err := p.Query(net.ParseIP("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if queries := p.Stats().Queries; queries != 2 {
+		t.Fatalf("query for another address sent %d requests in total, want 2", queries)
+	}
+
+	time.Sleep(time.Until(started.Add(window + 50*time.Millisecond)))
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if queries := p.Stats().Queries; queries != 3 {
+		t.Fatalf("query after the window sent %d requests in total, want 3", queries)
+	}
+}
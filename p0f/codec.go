@@ -0,0 +1,218 @@
+package p0f
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+)
+
+var errBadMagic = errors.New("invalid magic bytes in response")
+
+// Wire format of a p0f API response.
+//
+// Used as a temp struct to avoid returning Magic and Status (which are always the same on success),
+// as well as removing null terminators from the strings
+type rawResponse struct {
+	Magic      uint32          // Must be magicBytesRcv
+	Status     uint32          // result*
+	FirstSeen  uint32          // First seen (unix time)
+	LastSeen   uint32          // Last seen (unix time)
+	TotalCount uint32          // Total connections seen
+	UptimeMin  uint32          // Last uptime (minutes)
+	UpModDays  uint32          // Uptime modulo (days)
+	LastNat    uint32          // NAT / LB last detected (unix time)
+	LastChg    uint32          // OS chg last detected (unix time)
+	Distance   uint16          // System distance
+	BadSw      byte            // Host is lying about U-A / Server
+	OsMatchQ   byte            // Match quality
+	OsName     [p0fStrMax]byte // Name of detected OS
+	OsFlavor   [p0fStrMax]byte // Flavor of detected OS
+	HttpName   [p0fStrMax]byte // Name of detected HTTP app
+	HttpFlavor [p0fStrMax]byte // Flavor of detected HTTP app
+	LinkMtu    uint16          // Link MTU value
+	LinkType   [p0fStrMax]byte // Link type
+	Language   [p0fStrMax]byte // Language
+}
+
+// Encodes the query frame for ip, to be written to the p0f socket.
+// IPv4 and IPv4-mapped IPv6 addresses are queried as IPv4. An error wrapping ErrInvalidIP
+// is returned if ip is neither 4 nor 16 bytes long. Multi-byte fields use the native byte order,
+// as p0f does, see WithByteOrder.
+func EncodeRequest(ip net.IP) ([RequestSize]byte, error) {
+	return encodeRequest(binary.NativeEndian, ip)
+}
+
+// Decodes a single response frame read from the p0f socket, the counterpart of EncodeRequest.
+// ip is the queried address, which p0f does not echo back.
+// b must hold a full frame of ResponseSize bytes, anything shorter is rejected.
+//
+// Results other than a match are returned as ErrNoMatch or ErrBadQuery.
+func DecodeResponse(ip string, b []byte) (P0fResponse, error) {
+	return decodeResponse(binary.NativeEndian, ip, b)
+}
+
+func encodeRequest(order binary.ByteOrder, ip net.IP) (buffer [RequestSize]byte, err error) {
+	err = putRequest(order, &buffer, ip)
+	return
+}
+
+// Same as encodeRequest, into buffer, so writeRequest can reuse buffers.
+func putRequest(order binary.ByteOrder, buffer *[RequestSize]byte, ip net.IP) error {
+	*buffer = [RequestSize]byte{}
+	order.PutUint32(buffer[0:4], magicBytesSend)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		buffer[4] = ipv4Dword
+		copy(buffer[5:], ip4)
+	} else if ip6 := ip.To16(); ip6 != nil {
+		buffer[4] = ipv6Dword
+		copy(buffer[5:], ip6)
+	} else {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidIP, len(ip))
+	}
+	return nil
+}
+
+// Decodes a query frame, the counterpart of encodeRequest.
+func decodeRequest(order binary.ByteOrder, b []byte) (net.IP, error) {
+	if len(b) < RequestSize {
+		return nil, fmt.Errorf("short request: got %d bytes, want %d", len(b), RequestSize)
+	}
+	if order.Uint32(b[0:4]) != magicBytesSend {
+		return nil, errors.New("invalid magic bytes in request")
+	}
+	switch b[4] {
+	case ipv4Dword:
+		return net.IPv4(b[5], b[6], b[7], b[8]), nil
+	case ipv6Dword:
+		return net.IP(bytes.Clone(b[5:21])), nil
+	default:
+		return nil, fmt.Errorf("invalid address type %d", b[4])
+	}
+}
+
+// Decodes a query frame sent by a p0f client, for implementing the p0f API,
+// such as in fakes for tests (see the p0ftest package). Multi-byte fields use the native byte order, as p0f does.
+func DecodeRequest(b []byte) (net.IP, error) {
+	return decodeRequest(binary.NativeEndian, b)
+}
+
+// Encodes the response frame answering a query, the counterpart of DecodeRequest.
+// A nil err answers with resp, ErrNoMatch with no match, and any other error with bad query,
+// these being the results p0f reports.
+func EncodeResponse(resp P0fResponse, err error) []byte {
+	switch {
+	case err == nil:
+		return encodeResponse(binary.NativeEndian, resultOk, resp)
+	case errors.Is(err, ErrNoMatch):
+		return encodeResponse(binary.NativeEndian, resultNoMatch, P0fResponse{})
+	default:
+		return encodeResponse(binary.NativeEndian, resultBadQuery, P0fResponse{})
+	}
+}
+
+// Encodes a response frame with the given result status.
+// The fields of resp are only encoded for resultOk, strings longer than p0fStrMax are truncated.
+func encodeResponse(order binary.ByteOrder, status uint32, resp P0fResponse) []byte {
+	r := rawResponse{Magic: magicBytesRcv, Status: status}
+	if status == resultOk {
+		r.FirstSeen, r.LastSeen, r.TotalCount = resp.FirstSeen, resp.LastSeen, resp.TotalCount
+		r.UptimeMin, r.UpModDays = resp.UptimeMin, resp.UpModDays
+		r.LastNat, r.LastChg = resp.LastNat, resp.LastChg
+		r.Distance, r.BadSw, r.OsMatchQ, r.LinkMtu = resp.Distance, resp.BadSw, resp.OsMatchQ, resp.LinkMtu
+		cstr(&r.OsName, resp.OsName)
+		cstr(&r.OsFlavor, resp.OsFlavor)
+		cstr(&r.HttpName, resp.HttpName)
+		cstr(&r.HttpFlavor, resp.HttpFlavor)
+		cstr(&r.LinkType, resp.LinkType)
+		cstr(&r.Language, resp.Language)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, ResponseSize))
+	binary.Write(buf, order, &r) // cannot fail for a fixed size struct
+	// Pad to the size of the C struct, which includes trailing alignment
+	buf.Write(make([]byte, ResponseSize-buf.Len()))
+	return buf.Bytes()
+}
+
+func decodeResponse(order binary.ByteOrder, ip string, b []byte) (resp P0fResponse, err error) {
+	if len(b) < ResponseSize {
+		err = fmt.Errorf("short response: got %d bytes, want %d", len(b), ResponseSize)
+		return
+	}
+	var r rawResponse
+	// Decode reads b in place, unlike binary.Read which copies it first
+	if _, err = binary.Decode(b, order, &r); err != nil {
+		return
+	}
+	if r.Magic != magicBytesRcv {
+		err = errBadMagic
+		return
+	}
+	switch r.Status {
+	case resultOk:
+		resp = P0fResponse{
+			Ip:         ip,
+			FirstSeen:  r.FirstSeen,
+			LastSeen:   r.LastSeen,
+			TotalCount: r.TotalCount,
+			UptimeMin:  r.UptimeMin,
+			UpModDays:  r.UpModDays,
+			LastNat:    r.LastNat,
+			LastChg:    r.LastChg,
+			Distance:   r.Distance,
+			BadSw:      r.BadSw,
+			OsMatchQ:   r.OsMatchQ,
+			OsName:     trstr(r.OsName),
+			OsFlavor:   trstr(r.OsFlavor),
+			HttpName:   trstr(r.HttpName),
+			HttpFlavor: trstr(r.HttpFlavor),
+			LinkMtu:    r.LinkMtu,
+			LinkType:   trstr(r.LinkType),
+			Language:   trstr(r.Language),
+		}
+		resp.LinkClass = classifyLinkType(resp.LinkType)
+		resp.Flags = computeFlags(resp)
+		return
+	case resultBadQuery:
+		err = ErrBadQuery
+	case resultNoMatch:
+		err = ErrNoMatch
+	default:
+		err = fmt.Errorf("unknown response code %d", r.Status)
+	}
+	return
+}
+
+// Converts a null terminated C string to a Go string, or nil if it is empty.
+//
+// The bytes come straight from the socket and end up in JSON served to browsers,
+// so invalid UTF-8 is replaced by U+FFFD and control characters are removed.
+// A string left empty by this is nil as well.
+func trstr(cStr [p0fStrMax]byte) *string {
+	n := bytes.IndexByte(cStr[:], 0)
+	if n < 0 {
+		// All 32 bytes are not null, use the full 32 char string
+		n = len(cStr)
+	}
+	goStr := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(string(cStr[:n]), "\uFFFD"))
+	if goStr == "" {
+		return nil
+	}
+	return &goStr
+}
+
+// The inverse of trstr, copying s into a null terminated C string.
+func cstr(dst *[p0fStrMax]byte, s *string) {
+	if s != nil {
+		copy(dst[:], *s)
+	}
+}
@@ -0,0 +1,156 @@
+package p0f
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+func encodeRaw(t testing.TB, r rawResponse) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.NativeEndian, r); err != nil {
+		t.Fatal(err)
+	}
+	// Pad to the size of the C struct, which includes trailing alignment
+	return append(buf.Bytes(), make([]byte, ResponseSize-buf.Len())...)
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	match := rawResponse{Magic: magicBytesRcv, Status: resultOk, Distance: 12, LinkMtu: 1500}
+	copy(match.OsName[:], "Linux")
+	copy(match.OsFlavor[:], "3.11 and newer")
+	for i := range match.Language {
+		match.Language[i] = 'x' // no null terminator
+	}
+	junk := match
+	copy(junk.HttpName[:], "\xff\xfe\x00")
+	copy(junk.LinkType[:], "<script>\x1b[31m\u2028\xc3")
+
+	f.Add(encodeRaw(f, match))
+	f.Add(encodeRaw(f, junk))
+	f.Add(encodeRaw(f, rawResponse{Magic: magicBytesRcv, Status: resultNoMatch}))
+	f.Add(encodeRaw(f, rawResponse{Magic: magicBytesRcv, Status: resultBadQuery}))
+	f.Add(encodeRaw(f, rawResponse{Magic: magicBytesRcv, Status: 0xFF}))
+	f.Add(encodeRaw(f, rawResponse{Magic: magicBytesSend, Status: resultOk}))
+	f.Add(encodeRaw(f, match)[:ResponseSize-1])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp, err := DecodeResponse("192.0.2.1", b)
+		if err != nil {
+			if !reflect.DeepEqual(resp, P0fResponse{}) {
+				t.Fatalf("non-empty response returned with error %v", err)
+			}
+			return
+		}
+		if len(b) < ResponseSize {
+			t.Fatalf("decoded a %d byte frame", len(b))
+		}
+		if resp.Ip != "192.0.2.1" {
+			t.Fatalf("ip = %q", resp.Ip)
+		}
+		for _, s := range []*string{resp.OsName, resp.OsFlavor, resp.HttpName, resp.HttpFlavor, resp.LinkType, resp.Language} {
+			if s == nil {
+				continue
+			}
+			if len(*s) == 0 || utf8.RuneCountInString(*s) > p0fStrMax {
+				t.Fatalf("string field has invalid length %d", len(*s))
+			}
+			if !utf8.ValidString(*s) || strings.IndexFunc(*s, unicode.IsControl) >= 0 {
+				t.Fatalf("string field %q is not valid UTF-8 free of control characters", *s)
+			}
+		}
+		// Whatever the strings hold, the JSON served to browsers must be valid
+		out, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatalf("encoding the response as JSON: %v", err)
+		}
+		if !utf8.Valid(out) {
+			t.Fatalf("JSON encoding of the response is not valid UTF-8: %q", out)
+		}
+	})
+}
+
+func TestDecodeResponseBigEndian(t *testing.T) {
+	frame := make([]byte, ResponseSize)
+	copy(frame[0:], []byte{0x50, 0x30, 0x46, 0x02}) // magic
+	copy(frame[4:], []byte{0, 0, 0, resultOk})
+	copy(frame[8:], []byte{0x65, 0x92, 0x00, 0x80}) // FirstSeen
+	copy(frame[20:], []byte{0, 0, 0x01, 0x2c})      // UptimeMin
+	copy(frame[36:], []byte{0, 7})                  // Distance
+	copy(frame[40:], "Linux")
+	copy(frame[168:], []byte{0x05, 0xdc}) // LinkMtu
+	copy(frame[170:], "Ethernet or modem")
+
+	resp, err := decodeResponse(binary.BigEndian, "192.0.2.1", frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.FirstSeen != 0x65920080 || resp.UptimeMin != 300 || resp.Distance != 7 || resp.LinkMtu != 1500 {
+		t.Fatalf("decoded %+v, want FirstSeen 0x65920080, UptimeMin 300, Distance 7 and LinkMtu 1500", resp)
+	}
+	if resp.OsName == nil || *resp.OsName != "Linux" || resp.LinkClass != LinkEthernet {
+		t.Fatalf("decoded OsName %v and LinkClass %q, want Linux over ethernet", resp.OsName, resp.LinkClass)
+	}
+
+	request, err := encodeRequest(binary.BigEndian, net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x50, 0x30, 0x46, 0x01, ipv4Dword, 192, 0, 2, 1}; !bytes.Equal(request[:len(want)], want) {
+		t.Fatalf("request starts with % x, want % x", request[:len(want)], want)
+	}
+}
+
+func TestEncodeRequest(t *testing.T) {
+	for _, s := range []string{"192.0.2.1", "::ffff:192.0.2.1", "2001:db8::1"} {
+		ip := net.ParseIP(s)
+		frame, err := EncodeRequest(ip)
+		if err != nil {
+			t.Fatalf("EncodeRequest(%s) error = %v", s, err)
+		}
+		if decoded, err := DecodeRequest(frame[:]); err != nil || !decoded.Equal(ip) {
+			t.Errorf("DecodeRequest(EncodeRequest(%s)) = %v, %v", s, decoded, err)
+		}
+	}
+	if _, err := EncodeRequest(net.IP{192, 0, 2}); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("EncodeRequest of a 3 byte IP error = %v, want %v", err, ErrInvalidIP)
+	}
+
+	response := syntheticResponse(net.ParseIP("192.0.2.1"))
+	decoded, err := DecodeResponse("192.0.2.1", EncodeResponse(response, nil))
+	if err != nil || decoded.FirstSeen != response.FirstSeen || *decoded.OsName != *response.OsName {
+		t.Errorf("DecodeResponse(EncodeResponse(r)) = %+v, %v, want %+v", decoded, err, response)
+	}
+	if _, err := DecodeResponse("192.0.2.1", EncodeResponse(P0fResponse{}, ErrNoMatch)); err != ErrNoMatch {
+		t.Errorf("DecodeResponse of a no match frame error = %v, want %v", err, ErrNoMatch)
+	}
+}
+
+func TestTrstrSanitizes(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want *string
+	}{
+		{"", nil},
+		{"Linux", syntheticString("Linux")},
+		{"Mac\x00 OS", syntheticString("Mac")},
+		{"a\xffb", syntheticString("a�b")},
+		{"\x1b[31mred\x7f", syntheticString("[31mred")},
+		{"\r\n\t", nil},
+	} {
+		var cStr [p0fStrMax]byte
+		copy(cStr[:], test.in)
+		got := trstr(cStr)
+		if (got == nil) != (test.want == nil) || got != nil && *got != *test.want {
+			t.Errorf("trstr(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package p0f
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A worker owns one connection to the p0f socket at a time, replaced on reconnects,
+// and writes the requests it takes from the shared request queue to it.
+// Each worker has its own connection, so requests of different workers never interleave on a socket.
+type worker struct {
+	connMu       sync.Mutex // Guards conn, the current connection
+	conn         *p0fConn
+	inflight     chan struct{} // Holds a token for each request written but not yet answered
+	reconnecting atomic.Bool   // Set while reconnectAsync is running
+	gaveUp       atomic.Bool   // Set once reconnectAsync exhausted WithReconnectLimit, until a reconnect succeeds
+}
+
+// A connection to the p0f socket.
+//
+// Requests are written by start(), which then hands them to the reader goroutine
+// of the connection through pending. p0f answers queries in the order they were sent,
+// so the reader completes pending requests in order as responses arrive.
+// This lets the next request be written while a response is still being read.
+//
+// Reads and writes are not serialized against each other: readLoop is the only goroutine
+// reading conn, and writes are serialized by writeMu alone, so a slow read never holds up a write.
+// worker.connMu only guards which connection is current, and is never held during I/O.
+type p0fConn struct {
+	conn    net.Conn
+	reader  net.Conn         // conn with buffered reads, only used by readLoop
+	writeMu sync.Mutex       // Held while writing to conn and handing the request to pending
+	closed  bool             // Set under writeMu once pending has been closed
+	pending chan *p0fRequest // Closed once no more requests will be written
+	healthy atomic.Bool      // Set once dialed and after each round trip, cleared once reading or writing failed
+}
+
+// Wraps conn as a connection of w and starts its reader goroutine.
+func (p *P0f) newConn(w *worker, conn net.Conn) *p0fConn {
+	c := &p0fConn{conn: retryConn{conn, p.allowRetry}, pending: make(chan *p0fRequest, cap(w.inflight))}
+	// Room for every response the pipeline can have outstanding, so responses p0f sent
+	// back to back are taken with a single read
+	c.reader = bufferedConn{c.conn, bufio.NewReaderSize(c.conn, cap(w.inflight)*ResponseSize)}
+	c.healthy.Store(true)
+	go p.readLoop(w, c)
+	return c
+}
+
+// A net.Conn reading from r, which buffers reads from the Conn.
+// Only reads are buffered, writes go straight to the Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Returns the current connection of w.
+func (w *worker) currentConn() *p0fConn {
+	w.connMu.Lock()
+	defer w.connMu.Unlock()
+	return w.conn
+}
+
+// Closes the current p0f connections and dials new ones.
+// Requests already sent are completed on the old connections before they are closed.
+// If some connections cannot be re-dialed, they are kept and the errors are returned.
+func (p *P0f) Reconnect() error {
+	var errs []error
+	for _, w := range p.workers {
+		if err := p.reconnect(w); err == ErrShutdown {
+			return err
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replaces the connection of w by a newly dialed one.
+func (p *P0f) reconnect(w *worker) error {
+	if p.shutdown.Load() {
+		return ErrShutdown
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	w.connMu.Lock()
+	if p.shutdown.Load() {
+		// start() may have closed the connection already, don't leak the new one
+		w.connMu.Unlock()
+		conn.Close()
+		return ErrShutdown
+	}
+	old := w.conn
+	w.conn = p.newConn(w, conn)
+	w.connMu.Unlock()
+
+	old.close()
+	w.gaveUp.Store(false)
+	p.stats.reconnects.Add(1)
+	if p.opts.reconnectedHook != nil {
+		p.opts.reconnectedHook()
+	}
+	return nil
+}
+
+// Stops writes to c, once a write in progress has been handed to its reader.
+// The reader then completes the pending requests and closes the connection.
+func (c *p0fConn) close() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.pending)
+	}
+}
+
+// Writes request to c, the connection of w, and hands it to the reader of c.
+// false is returned without writing if c was closed by a reconnect.
+func (p *P0f) send(w *worker, c *p0fConn, request *p0fRequest) bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return false
+	}
+	request.sent = time.Now()
+	if written, err := writeRequest(c.conn, p.opts.byteOrder, request, p.opts.writeTimeout); err != nil {
+		if !errors.Is(err, ErrInvalidIP) {
+			c.healthy.Store(false)
+		}
+		switch {
+		case errors.Is(err, ErrInvalidIP):
+			// Nothing was written, the connection is fine
+		case err == ErrTimeout:
+			// Part of the request may have been written, later ones would be misread by p0f
+			p.stats.timeouts.Add(1)
+			p.reconnectAsync(w, "timeout")
+		case written > 0:
+			// The rest of the stream would be misread by p0f, start over on a new connection
+			err = fmt.Errorf("partial write of %d of %d bytes: %w", written, RequestSize, err)
+			p.reconnectAsync(w, "partial write")
+		case p.opts.reconnectMax > 0:
+			err = fmt.Errorf("%w: %w", ErrDisconnected, err)
+			p.reconnectAsync(w, "connection lost")
+		}
+		p.complete(request, err)
+	} else {
+		c.pending <- request
+	}
+	return true
+}
+
+// Reports whether p can currently reach p0f, which is the case while one of its connections is usable.
+// A connection is usable once dialed and after each query it answered, and stops being usable
+// once reading from or writing to it fails, until it is re-established (see WithReconnect).
+// Once reconnecting gave up (see WithReconnectLimit), that lasts until Reconnect succeeds.
+// Always false once p is shut down. p0f is not queried, so this is cheap enough to poll.
+func (p *P0f) IsConnected() bool {
+	if p.shutdown.Load() {
+		return false
+	}
+	for _, w := range p.workers {
+		if w.currentConn().healthy.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the path of the p0f socket file p was created with.
+func (p *P0f) SocketFile() string {
+	return p.sockFile
+}
+
+// Long running background routine of w that writes queued requests to p0f.
+// Responses are delivered back to waiting goroutines by readLoop.
+func (p *P0f) start(w *worker) {
+	defer func() {
+		w.connMu.Lock()
+		w.conn.close()
+		w.connMu.Unlock()
+	}()
+
+	lastUsed := time.Now()
+	for {
+		// Wait for the pipeline to have room before taking a request,
+		// so requests are left to workers that can send them right away
+		w.inflight <- struct{}{}
+		request, ok := <-p.requestQueue
+		if !ok {
+			// Channel closed by Shutdown and drained, exit
+			return
+		}
+		if p.shutdown.Load() {
+			// Fail what is left in the queue rather than leaving its callers waiting forever
+			<-w.inflight
+			request.err = ErrShutdown
+			close(request.done)
+			continue
+		}
+		if p.opts.idleReconnect > 0 && time.Since(lastUsed) > p.opts.idleReconnect {
+			if err := p.reconnect(w); err != nil {
+				p.opts.logger.Printf("idle reconnect failed: %v", err)
+			}
+		}
+		if request.abandoned.Load() {
+			<-w.inflight
+			close(request.done)
+			continue
+		}
+		lastUsed = time.Now()
+
+		request.inflight = w.inflight
+		for !p.send(w, w.currentConn(), request) {
+			// Replaced while we were about to write, the new connection is current now
+		}
+	}
+}
+
+// Reads the responses of the requests written to c, until c is replaced or p is shut down.
+//
+// Once reading fails, the stream can no longer be trusted to be aligned,
+// so every request still pending on c fails with the same error.
+func (p *P0f) readLoop(w *worker, c *p0fConn) {
+	defer c.conn.Close()
+
+	var streamErr error
+	for request := range c.pending {
+		if streamErr != nil {
+			p.complete(request, streamErr)
+			continue
+		}
+		response, err := readResponse(c.reader, p.opts.byteOrder, request.ip.String(), p.opts.readTimeout)
+		switch err {
+		case nil, ErrNoMatch, ErrBadQuery:
+			c.healthy.Store(true)
+		case errBadMagic:
+			// p0f does not echo the queried IP, so a frame with bad magic bytes is the only
+			// sign that responses are no longer aligned with their requests.
+			// Start over on a new connection rather than handing later requests someone else's answer.
+			p.stats.resyncs.Add(1)
+			p.reconnectAsync(w, "resync")
+			streamErr = err
+		case ErrTimeout:
+			// The late response may still arrive and would be taken for the next one
+			p.stats.timeouts.Add(1)
+			p.reconnectAsync(w, "timeout")
+			streamErr = err
+		default:
+			if p.opts.reconnectMax > 0 {
+				err = fmt.Errorf("%w: %w", ErrDisconnected, err)
+				p.reconnectAsync(w, "connection lost")
+			}
+			streamErr = err
+		}
+		if streamErr != nil {
+			c.healthy.Store(false)
+		}
+		request.response = response
+		p.complete(request, err)
+	}
+}
+
+// Delivers the outcome of request to the goroutine waiting on it.
+func (p *P0f) complete(request *p0fRequest, err error) {
+	if err == nil && p.opts.sanitizer != nil {
+		sanitizeResponse(&request.response, p.opts.sanitizer)
+		// Derived from the LinkType and flags the sanitizer may have changed
+		request.response.LinkClass = classifyLinkType(request.response.LinkType)
+		request.response.Flags = computeFlags(request.response)
+	}
+	if err == nil && p.osHistory != nil && request.response.OsName != nil {
+		p.osHistory.observe(request.ip.String(), *request.response.OsName)
+	}
+	if err == nil && p.opts.anonymizeIP {
+		request.response.Ip = AnonymizeIP(request.ip).String()
+	}
+	request.err = err
+	p.stats.record(err)
+	if !request.sent.IsZero() {
+		roundTrip := time.Since(request.sent)
+		p.stats.observeRoundTrip(roundTrip)
+		p.stats.roundTrips.observe(roundTrip)
+	}
+	p.stats.duration.observe(time.Since(request.queued))
+	<-request.inflight
+	close(request.done)
+}
+
+// Reconnects w on a new goroutine, for callers holding locks reconnect takes.
+// With WithReconnect, failed attempts are retried with exponential backoff until one succeeds,
+// otherwise a single attempt is made. Calls made while w is reconnecting have no effect.
+func (p *P0f) reconnectAsync(w *worker, reason string) {
+	if w.gaveUp.Load() || !w.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer w.reconnecting.Store(false)
+		started := time.Now()
+		delay := p.opts.reconnectMin
+		attempts := 0
+		for retry := false; ; retry = true {
+			// The first attempt is not a retry, later ones draw from the retry budget
+			if !retry || p.allowRetry() {
+				attempts++
+				err := p.reconnect(w)
+				if err == ErrShutdown {
+					return
+				}
+				if p.opts.reconnectHook != nil {
+					p.opts.reconnectHook(attempts, err)
+				}
+				if err == nil {
+					return
+				}
+				p.opts.logger.Printf("%s reconnect failed: %v", reason, err)
+			}
+			if p.opts.reconnectMax == 0 {
+				return
+			}
+			if p.reconnectExhausted(attempts, time.Since(started)) {
+				w.gaveUp.Store(true)
+				p.opts.logger.Printf("giving up reconnecting after %d attempts in %s", attempts, time.Since(started).Round(time.Millisecond))
+				return
+			}
+			time.Sleep(jitter(delay))
+			delay = min(delay*2, p.opts.reconnectMax)
+		}
+	}()
+}
+
+// Reports whether the limits of WithReconnectLimit are reached
+// after attempts reconnect attempts over elapsed.
+func (p *P0f) reconnectExhausted(attempts int, elapsed time.Duration) bool {
+	return (p.opts.reconnectMaxAttempts > 0 && attempts >= p.opts.reconnectMaxAttempts) ||
+		(p.opts.reconnectMaxElapsed > 0 && elapsed >= p.opts.reconnectMaxElapsed)
+}
+
+// Returns a random duration between half of d and d, so instances reconnecting
+// after the same p0f restart spread their attempts instead of retrying in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+// Frame buffers of writeRequest and readResponse, which are needed for every query
+var (
+	requestBuffers  = sync.Pool{New: func() any { return new([RequestSize]byte) }}
+	responseBuffers = sync.Pool{New: func() any { return new([ResponseSize]byte) }}
+)
+
+// Writes request to conn in the given byte order, failing with ErrTimeout if that takes longer than timeout (0 for no limit).
+// Short writes are continued until the whole request is written or writing fails,
+// written is the number of bytes written either way.
+func writeRequest(conn net.Conn, order binary.ByteOrder, request *p0fRequest, timeout time.Duration) (written int, err error) {
+	buffer := requestBuffers.Get().(*[RequestSize]byte)
+	defer requestBuffers.Put(buffer)
+	if err := putRequest(order, buffer, request.ip); err != nil {
+		return 0, err
+	}
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	for written < len(buffer) {
+		n, err := conn.Write(buffer[written:])
+		written += n
+		if err != nil {
+			return written, timeoutErr(err)
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Reads the response to a query for ip from conn in the given byte order, failing with ErrTimeout
+// if it does not arrive within timeout (0 for no limit).
+func readResponse(conn net.Conn, order binary.ByteOrder, ip string, timeout time.Duration) (resp P0fResponse, err error) {
+	responseBytes := responseBuffers.Get().(*[ResponseSize]byte)
+	defer responseBuffers.Put(responseBytes)
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	// A stream socket may return a frame over several reads
+	if _, err = io.ReadFull(conn, responseBytes[:]); err != nil {
+		return resp, timeoutErr(err)
+	}
+	// The response holds no reference to the buffer, it can be reused once decoded
+	return decodeResponse(order, ip, responseBytes[:])
+}
+
+// Replaces an expired deadline error by ErrTimeout.
+func timeoutErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrTimeout
+	}
+	return err
+}
@@ -0,0 +1,459 @@
+package p0f
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves a unix socket with handle, called on a new goroutine with each accepted connection
+
+// and its number, counting from 0, for tests scripting how p0f answers.
+func serveConns(tb testing.TB, handle func(n int, conn net.Conn)) string {
+	sockFile := filepath.Join(tb.TempDir(), "p0f.sock")
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(n, conn)
+			}()
+		}
+	}()
+	return sockFile
+}
+
+// Returns the addresses of the requests read from conn, closed once reading fails.
+func readRequests(conn net.Conn) <-chan net.IP {
+	ips := make(chan net.IP, 1024)
+	go func() {
+		defer close(ips)
+		buffer := make([]byte, RequestSize)
+		for {
+			if _, err := io.ReadFull(conn, buffer); err != nil {
+				return
+			}
+			ip, _ := decodeRequest(binary.NativeEndian, buffer)
+			ips <- ip
+		}
+	}()
+	return ips
+}
+
+// Serves synthetic responses on a unix socket, answering each request latency after it was read.
+
+// Requests keep being read while earlier responses are pending, as p0f does.
+func serveDelayed(tb testing.TB, latency time.Duration) string {
+	sockFile := filepath.Join(tb.TempDir(), "p0f.sock")
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			type received struct {
+				ip net.IP
+				at time.Time
+			}
+			queue := make(chan received, 1024)
+			go func() {
+				defer close(queue)
+				buffer := make([]byte, RequestSize)
+				for {
+					if _, err := io.ReadFull(conn, buffer); err != nil {
+						return
+					}
+					ip, _ := decodeRequest(binary.NativeEndian, buffer)
+					queue <- received{ip, time.Now()}
+				}
+			}()
+			go func() {
+				defer conn.Close()
+				for r := range queue {
+					time.Sleep(time.Until(r.at.Add(latency)))
+					if _, err := conn.Write(encodeResponse(binary.NativeEndian, resultOk, syntheticResponse(r.ip))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return sockFile
+}
+
+// Measures query throughput against a p0f answering each query after 100µs,
+
+// with and without pipelining. Reads and writes of the connection don't share a lock,
+
+// so with a depth above 1 requests keep being written while responses are read.
+func BenchmarkQueryPipelined(b *testing.B) {
+	sockFile := serveDelayed(b, 100*time.Microsecond)
+	for _, depth := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			p, err := New(sockFile, WithPipelineDepth(depth))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.Shutdown()
+
+			ip := net.ParseIP("192.0.2.1")
+			b.SetParallelism(depth)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := p.Query(ip); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Breaks the connection with several requests in flight: the answered ones get their own response,
+
+// and every pending one fails rather than waiting forever.
+func TestPipelineConnectionLost(t *testing.T) {
+	const depth, queries, answered = 4, 6, 2
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, RequestSize)
+		for range answered {
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			conn.Write(matchResponse(uint32(request[8]), 0))
+		}
+		// Wait for the pipeline to fill up again, then drop the connection
+		for range depth {
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+		}
+	}()
+	p, err := New(sockFile, WithPipelineDepth(depth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	type result struct {
+		ip       net.IP
+		response P0fResponse
+		err      error
+	}
+	results := make(chan result, queries)
+	for i := range queries {
+		go func() {
+			ip := net.IPv4(192, 0, 2, byte(i+1))
+			response, err := p.Query(ip)
+			results <- result{ip, response, err}
+		}()
+	}
+	succeeded, failed := 0, 0
+	for range queries {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				failed++
+				continue
+			}
+			succeeded++
+			if want := uint32(r.ip.To4()[3]); r.response.FirstSeen != want {
+				t.Errorf("Query(%s) got FirstSeen %d, want %d", r.ip, r.response.FirstSeen, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d queries still waiting after the connection was lost", queries-succeeded-failed)
+		}
+	}
+	if succeeded != answered || failed != depth {
+		t.Fatalf("%d queries succeeded and %d failed, want %d and %d", succeeded, failed, answered, depth)
+	}
+}
+
+// Same as BenchmarkQueryPipelined, spreading queries over several connections instead.
+func BenchmarkQueryConnections(b *testing.B) {
+	sockFile := serveDelayed(b, 100*time.Microsecond)
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("connections=%d", n), func(b *testing.B) {
+			p, err := New(sockFile, WithConnections(n))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer p.Shutdown()
+
+			ip := net.ParseIP("192.0.2.1")
+			b.SetParallelism(n)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := p.Query(ip); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestConnectionsParallel(t *testing.T) {
+	const n, latency = 4, 100 * time.Millisecond
+	sockFile := serveDelayed(t, latency)
+	p, err := New(sockFile, WithConnections(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := net.IPv4(192, 0, 2, byte(i))
+			response, err := p.Query(ip)
+			if err != nil {
+				t.Error(err)
+			} else if want := syntheticResponse(ip); response.FirstSeen != want.FirstSeen {
+				t.Errorf("Query(%s) got FirstSeen %d, want %d", ip, response.FirstSeen, want.FirstSeen)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(started); elapsed > 2*latency {
+		t.Fatalf("%d queries over %d connections took %s, want them answered in parallel", n, n, elapsed)
+	}
+}
+
+// Many goroutines sharing one pipelined connection each get the response for their own address.
+func TestReadResponseShortReads(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ip := net.ParseIP("192.0.2.1")
+	frame := encodeResponse(binary.NativeEndian, resultOk, syntheticResponse(ip))
+	go func() {
+		// Each write is returned by a separate read on the other end
+		for _, chunk := range [][]byte{frame[:1], frame[1:100], frame[100:]} {
+			server.Write(chunk)
+		}
+		server.Write(frame[:10])
+		server.Close()
+	}()
+
+	response, err := readResponse(client, binary.NativeEndian, ip.String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := syntheticResponse(ip); response.FirstSeen != want.FirstSeen {
+		t.Fatalf("FirstSeen = %d, want %d", response.FirstSeen, want.FirstSeen)
+	}
+	if _, err := readResponse(client, binary.NativeEndian, ip.String(), 0); err != io.ErrUnexpectedEOF {
+		t.Fatalf("error for a truncated frame = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// Returns frame over and over from Read, filling b as a socket with many responses
+// waiting would, and discards writes.
+type frameConn struct {
+	net.Conn
+	frame []byte
+	off   int
+	reads int
+}
+
+func (c *frameConn) Read(b []byte) (n int, err error) {
+	c.reads++
+	for n < len(b) {
+		copied := copy(b[n:], c.frame[c.off:])
+		c.off = (c.off + copied) % len(c.frame)
+		n += copied
+	}
+	return n, nil
+}
+
+func (c *frameConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// Measures the allocations of decoding frames without the socket, and how many reads of the socket
+// each response takes with responses waiting, reading the socket directly or through a bufferedConn
+// as readLoop does with a pipeline depth of 16.
+func BenchmarkReadResponse(b *testing.B) {
+	ip := net.ParseIP("192.0.2.1")
+	frame := encodeResponse(binary.NativeEndian, resultOk, syntheticResponse(ip))
+	for _, buffered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("buffered=%t", buffered), func(b *testing.B) {
+			conn := &frameConn{frame: frame}
+			var reader net.Conn = conn
+			if buffered {
+				reader = bufferedConn{conn, bufio.NewReaderSize(conn, 16*ResponseSize)}
+			}
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := readResponse(reader, binary.NativeEndian, "192.0.2.1", 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(conn.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkWriteRequest(b *testing.B) {
+	request := &p0fRequest{ip: net.ParseIP("192.0.2.1")}
+	conn := &frameConn{}
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := writeRequest(conn, binary.NativeEndian, request, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Accepts at most max bytes per Write, without reporting an error, until failAfter bytes were written.
+type shortWriteConn struct {
+	net.Conn
+	max       int
+	failAfter int
+	written   int
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if c.failAfter > 0 && c.written >= c.failAfter {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.Conn.Write(b[:min(c.max, len(b))])
+	c.written += n
+	return n, err
+}
+
+func TestWriteRequestShortWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		received <- b
+	}()
+
+	ip := net.ParseIP("2001:db8::1")
+	written, err := writeRequest(&shortWriteConn{Conn: client, max: 4}, binary.NativeEndian, &p0fRequest{ip: ip}, 0)
+	if err != nil || written != RequestSize {
+		t.Fatalf("writeRequest = %d, %v, want %d, nil", written, err, RequestSize)
+	}
+	client.Close()
+	want, _ := EncodeRequest(ip)
+	if got := <-received; string(got) != string(want[:]) {
+		t.Fatalf("received % x, want % x", got, want)
+	}
+}
+
+func TestWriteRequestPartialFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+
+	written, err := writeRequest(&shortWriteConn{Conn: client, max: 4, failAfter: 8}, binary.NativeEndian, &p0fRequest{ip: net.ParseIP("192.0.2.1")}, 0)
+	if err == nil || written != 8 {
+		t.Fatalf("writeRequest = %d, %v, want 8 and an error", written, err)
+	}
+}
+
+func TestDialerTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSyntheticConn(conn, binary.NativeEndian, nil)
+		}
+	}()
+
+	p, err := New("", WithDialer(func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	response, err := p.Query(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := syntheticResponse(ip); response.FirstSeen != want.FirstSeen {
+		t.Fatalf("FirstSeen = %d, want %d", response.FirstSeen, want.FirstSeen)
+	}
+}
+
+func TestPipelineInOrder(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(ip net.IP) []byte {
+		// A match first seen at the address itself, telling responses apart
+		return matchResponse(binary.BigEndian.Uint32(ip.To4()), 0)
+	})
+	p, err := New(sockFile, WithPipelineDepth(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	var wg sync.WaitGroup
+	for g := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				ip := net.IPv4(10, byte(g), byte(i), 1)
+				response, err := p.Query(ip)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if want := binary.BigEndian.Uint32(ip.To4()); response.FirstSeen != want {
+					t.Errorf("Query(%s) got FirstSeen %d, want %d", ip, response.FirstSeen, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
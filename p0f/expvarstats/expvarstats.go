@@ -0,0 +1,39 @@
+// Package expvarstats publishes the Stats of a p0f.P0f as an expvar variable.
+//
+// It is kept out of package p0f because importing expvar registers /debug/vars on
+// http.DefaultServeMux, which also serves the command line and memory statistics of the process.
+// Programs serving DefaultServeMux expose those as soon as they import this package.
+package expvarstats
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+
+	"github.com/bluemods/p0f-go/p0f"
+)
+
+// Serializes the check and publication of names, as expvar.Publish panics on duplicates
+var mu sync.Mutex
+
+// Publishes the Stats of p as the expvar variable name, such as "p0f", so they are served
+// at /debug/vars with the other expvar variables. The variable reads the same counters as
+// Stats and WriteMetrics, so using it alongside them counts nothing twice.
+//
+// expvar variables cannot be removed, so name stays published after p is shut down
+// and cannot be reused: an error is returned if a variable with the same name is already published.
+func Publish(name string, p *p0f.P0f) error {
+	if name == "" {
+		return errors.New("expvar name must not be empty")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %q is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		return p.Stats()
+	}))
+	return nil
+}
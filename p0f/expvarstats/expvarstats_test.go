@@ -0,0 +1,39 @@
+package expvarstats
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bluemods/p0f-go/p0f"
+)
+
+// Numbers expvar names, which stay published for the rest of the process, across runs of -count
+var runs atomic.Int32
+
+func TestPublish(t *testing.T) {
+	p, err := p0f.New("", p0f.WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	name := fmt.Sprintf("p0f_test_%d", runs.Add(1))
+	if err := Publish(name, p); err != nil {
+		t.Fatal(err)
+	}
+	p.Query(net.ParseIP("192.0.2.1"))
+
+	var stats p0f.Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queries != 1 {
+		t.Errorf("Queries = %d, want 1", stats.Queries)
+	}
+	if err := Publish(name, p); err == nil {
+		t.Error("Publish with a published name succeeded")
+	}
+}
@@ -0,0 +1,177 @@
+package p0f
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Failover queries one of several P0f instances watching the same traffic, such as
+// two p0f daemons on separate sockets, so queries keep being answered while one is restarted.
+// Create one with NewFailover.
+type Failover struct {
+	sockFiles []string
+	opts      []Option
+	members   []atomic.Pointer[P0f] // In order of preference, nil until the socket could be dialed
+	active    atomic.Int32          // Index of the member queried first, never a nil one
+	closing   chan struct{}         // Closed by Shutdown, stops probeLoop
+	closeOnce sync.Once
+}
+
+// Creates a Failover over an instance created with New for each of sockFiles, in order of preference,
+// with opts applied to each. An error is returned if none of them can be created.
+// Members whose socket cannot be dialed yet are created later by the probe.
+//
+// Queries go to the first member, and to the next ones while it fails with an error reaching p0f.
+// Results from p0f, including ErrNoMatch, are returned as is. Every probeInterval, the members
+// preferred over the one queried are probed with IsConnected, and the first connected one gets
+// the queries back. Members created without WithReconnect are reconnected by the probe.
+func NewFailover(sockFiles []string, probeInterval time.Duration, opts ...Option) (*Failover, error) {
+	if len(sockFiles) == 0 {
+		return nil, errors.New("failover must have at least one socket")
+	}
+	if probeInterval <= 0 {
+		return nil, errors.New("probe interval must be positive")
+	}
+	f := &Failover{
+		sockFiles: sockFiles,
+		opts:      opts,
+		members:   make([]atomic.Pointer[P0f], len(sockFiles)),
+		closing:   make(chan struct{}),
+	}
+	var errs []error
+	active := -1
+	for i, sockFile := range sockFiles {
+		p, err := New(sockFile, opts...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		f.members[i].Store(p)
+		if active < 0 {
+			active = i
+		}
+	}
+	if active < 0 {
+		return nil, errors.Join(errs...)
+	}
+	f.active.Store(int32(active))
+	go f.probeLoop(probeInterval)
+	return f, nil
+}
+
+// Reports whether err failed reaching p0f, rather than being its answer or the caller's doing.
+func isTransportError(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrNoMatch),
+		errors.Is(err, ErrBadQuery),
+		errors.Is(err, ErrInvalidIP),
+		errors.Is(err, ErrQueueFull),
+		errors.Is(err, ErrShutdown),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// Returns the member currently queried first.
+func (f *Failover) Active() *P0f {
+	return f.members[f.active.Load()].Load()
+}
+
+// Same as P0f.Query, on the first member that can reach p0f.
+func (f *Failover) Query(ip net.IP) (P0fResponse, error) {
+	return f.QueryContext(context.Background(), ip)
+}
+
+// Same as P0f.QueryContext, on the first member that can reach p0f.
+// The active member is tried first, then the others in order of preference.
+// If none can reach p0f, the error of the last one is returned.
+func (f *Failover) QueryContext(ctx context.Context, ip net.IP) (response P0fResponse, err error) {
+	active := int(f.active.Load())
+	response, err = f.members[active].Load().QueryContext(ctx, ip)
+	if !isTransportError(err) {
+		return
+	}
+	for i := range f.members {
+		p := f.members[i].Load()
+		if i == active || p == nil {
+			continue
+		}
+		response, err = p.QueryContext(ctx, ip)
+		if !isTransportError(err) {
+			f.active.CompareAndSwap(int32(active), int32(i))
+			return
+		}
+	}
+	return
+}
+
+// Creates the members that could not be dialed yet and switches back to the most preferred
+// member that is connected, every interval until Shutdown.
+func (f *Failover) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.closing:
+			return
+		case <-ticker.C:
+		}
+		f.createMissing()
+		active := int(f.active.Load())
+		for i := range f.members[:active] {
+			p := f.members[i].Load()
+			if p == nil {
+				continue
+			}
+			if !p.IsConnected() && p.opts.reconnectMax == 0 {
+				p.Reconnect()
+			}
+			if p.IsConnected() {
+				f.active.CompareAndSwap(int32(active), int32(i))
+				break
+			}
+		}
+	}
+}
+
+// Creates the members whose socket can now be dialed.
+func (f *Failover) createMissing() {
+	for i := range f.members {
+		if f.members[i].Load() != nil {
+			continue
+		}
+		p, err := New(f.sockFiles[i], f.opts...)
+		if err != nil {
+			continue
+		}
+		f.members[i].Store(p)
+		select {
+		case <-f.closing:
+			// Shutdown may have run before the member was stored
+			p.Shutdown()
+			return
+		default:
+		}
+	}
+}
+
+// Shuts down every member, see P0f.Shutdown.
+func (f *Failover) Shutdown() {
+	f.closeOnce.Do(func() { close(f.closing) })
+	f.shutdownMembers()
+}
+
+func (f *Failover) shutdownMembers() {
+	for i := range f.members {
+		if p := f.members[i].Load(); p != nil {
+			p.Shutdown()
+		}
+	}
+}
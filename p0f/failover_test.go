@@ -0,0 +1,88 @@
+package p0f
+
+import (
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	dir := t.TempDir()
+	primary, secondary := filepath.Join(dir, "primary.sock"), filepath.Join(dir, "secondary.sock")
+	stopPrimary := serveSynthetic(t, primary)
+	defer serveSynthetic(t, secondary)()
+	f, err := NewFailover([]string{primary, secondary}, 20*time.Millisecond, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Shutdown()
+	ip := net.ParseIP("192.0.2.1")
+	if _, err := f.Query(ip); err != nil {
+		t.Fatalf("Query error = %v", err)
+	}
+	if f.Active().SocketFile() != primary {
+		t.Fatalf("active socket = %s, want the primary %s", f.Active().SocketFile(), primary)
+	}
+
+	stopPrimary()
+	if _, err := f.Query(ip); err != nil {
+		t.Fatalf("Query with the primary down error = %v", err)
+	}
+	if f.Active().SocketFile() != secondary {
+		t.Fatalf("active socket with the primary down = %s, want the secondary %s", f.Active().SocketFile(), secondary)
+	}
+
+	defer serveSynthetic(t, primary)()
+	deadline := time.Now().Add(2 * time.Second)
+	for f.Active().SocketFile() != primary {
+		if time.Now().After(deadline) {
+			t.Fatal("failover did not switch back to the primary once it was up again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := f.Query(ip); err != nil {
+		t.Fatalf("Query after switching back error = %v", err)
+	}
+}
+
+func TestFailoverSecondaryDown(t *testing.T) {
+	dir := t.TempDir()
+	primary, secondary := filepath.Join(dir, "primary.sock"), filepath.Join(dir, "secondary.sock")
+	stopPrimary := serveSynthetic(t, primary)
+	f, err := NewFailover([]string{primary, secondary}, 20*time.Millisecond, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatalf("NewFailover with the secondary down error = %v", err)
+	}
+	defer f.Shutdown()
+	ip := net.ParseIP("192.0.2.1")
+	if _, err := f.Query(ip); err != nil {
+		t.Fatalf("Query error = %v", err)
+	}
+
+	defer serveSynthetic(t, secondary)()
+	stopPrimary()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := f.Query(ip); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the secondary was not queried once it was up and the primary down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.Active().SocketFile() != secondary {
+		t.Fatalf("active socket = %s, want the secondary %s", f.Active().SocketFile(), secondary)
+	}
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewFailover([]string{filepath.Join(dir, "primary.sock"), filepath.Join(dir, "secondary.sock")}, time.Second)
+	if err == nil {
+		t.Fatal("NewFailover with every socket down succeeded")
+	}
+}
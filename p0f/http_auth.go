@@ -0,0 +1,48 @@
+package p0f
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Returns a validator for WithAuth accepting requests carrying one of keys,
+// either as "Authorization: Bearer <key>" or as "X-API-Key: <key>".
+//
+// Keys are compared in constant time. They are hashed first, so neither their content
+// nor their length can be learnt from response times.
+func APIKeyAuth(keys ...string) func(r *http.Request) bool {
+	hashes := make([][sha256.Size]byte, len(keys))
+	for i, key := range keys {
+		hashes[i] = sha256.Sum256([]byte(key))
+	}
+	return func(r *http.Request) bool {
+		key := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = bearer
+		}
+		if key == "" {
+			return false
+		}
+		hash := sha256.Sum256([]byte(key))
+		match := 0
+		for _, h := range hashes {
+			// Every key is compared, to not reveal which one matched
+			match |= subtle.ConstantTimeCompare(hash[:], h[:])
+		}
+		return match == 1
+	}
+}
+
+// Reports whether r is authorized by WithAuth, answering 401 Unauthorized if not.
+// If false is returned, the response has already been written.
+func (s *httpServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if s.cfg.auth == nil || s.cfg.auth(r) {
+		return true
+	}
+	s.log.Printf("%s: unauthorized request for %s\n", s.logAddr(r.RemoteAddr), r.URL.Path)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
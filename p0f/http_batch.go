@@ -0,0 +1,129 @@
+package p0f
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Queries of a batch request running at once
+const batchParallelism = 64
+
+// One element of a batch response
+type batchResult struct {
+	Ip       string       `json:"ip"`
+	Response *P0fResponse `json:"response,omitempty"`
+	Error    *string      `json:"error,omitempty"`
+}
+
+// Handles a batch query (example: curl -d '["192.0.2.1","2001:db8::1"]' http://localhost:38749/batch).
+// The body is a JSON array of IP addresses, results are returned in the same order.
+// Queries that fail are reported per element rather than failing the whole batch,
+// but the request fails with 400 Bad Request if any element is not an IP address.
+func (s *httpServer) serveBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "close")
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.log.Printf("%s: bad batch request method %s\n", s.logAddr(r.RemoteAddr), r.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	// Only JSON is supported, checked before querying as the response could not be written anyway
+	w.Header().Add("Vary", "Accept")
+	if _, ok := acceptedFormat(r.Header.Get("Accept"), responseFormats[:1]); !ok {
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return
+	}
+	if s.shed() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	if retryAfter, saturated := s.saturated(); saturated {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var ipStrings []string
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&ipStrings); err != nil {
+		if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "body must be a JSON array of IP addresses", http.StatusBadRequest)
+		return
+	}
+	if len(ipStrings) > s.cfg.batchMaxIPs {
+		http.Error(w, "too many IP addresses", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ips := make([]net.IP, len(ipStrings))
+	for i, ipString := range ipStrings {
+		if ips[i] = net.ParseIP(strings.TrimSpace(ipString)); ips[i] == nil {
+			http.Error(w, fmt.Sprintf("invalid IP address %q", ipString), http.StatusBadRequest)
+			return
+		}
+	}
+
+	queried := 0
+	for _, ip := range ips {
+		if s.cfg.ipPermitted(ip) {
+			queried++
+		}
+	}
+	if !s.allowQueries(w, s.clientKey(r), queried) {
+		s.log.Printf("%s: batch of %d queries rate limited\n", s.logAddr(r.RemoteAddr), queried)
+		return
+	}
+
+	results := make([]batchResult, len(ipStrings))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchParallelism)
+	for i, ip := range ips {
+		results[i].Ip = ipStrings[i]
+		if !s.cfg.ipPermitted(ip) {
+			results[i].Error = errorString(errFiltered)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(result *batchResult) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if response, err := s.p.QueryContext(r.Context(), ip); err != nil {
+				result.Error = errorString(err)
+			} else {
+				result.Response = &response
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Has("p") {
+		enc.SetIndent("", " ")
+	}
+	if err := enc.Encode(results); err != nil {
+		s.log.Printf("batch response encode error: %s\n", err.Error())
+	}
+}
+
+// Error of batch results for addresses excluded by WithIPFilter.
+var errFiltered = errors.New("filtered")
+
+func errorString(err error) *string {
+	s := err.Error()
+	return &s
+}
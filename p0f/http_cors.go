@@ -0,0 +1,44 @@
+package p0f
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// How long browsers may cache the result of a preflight request, in seconds
+const corsMaxAge = "600"
+
+// Reports whether origin, the value of an Origin header, is allowed by WithCORS.
+func (c *httpConfig) originAllowed(origin string) bool {
+	return slices.ContainsFunc(c.corsOrigins, func(allowed string) bool {
+		return allowed == "*" || strings.EqualFold(allowed, origin)
+	})
+}
+
+// Adds the CORS headers for r to w, see WithCORS.
+// Reports whether r is a preflight request, which has then been answered.
+func (s *httpServer) cors(w http.ResponseWriter, r *http.Request) (preflight bool) {
+	origin := r.Header.Get("Origin")
+	preflight = r.Method == "OPTIONS" && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	w.Header().Add("Vary", "Origin")
+	if origin != "" && s.cfg.originAllowed(origin) {
+		// The origin is echoed rather than "*", so only allowed origins can read responses
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		} else {
+			w.Header().Set("Access-Control-Expose-Headers", "Retry-After, Warning")
+		}
+	}
+	if preflight {
+		// Without the headers above the browser rejects the request for disallowed origins
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return preflight
+}
@@ -0,0 +1,67 @@
+package p0f
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Returns the field names of the fields query parameter
+// (example: http://localhost:38749/?fields=osName,osFlavor,distance), nil if absent.
+// An error is returned for names that are not fields of query responses.
+func (s *httpServer) selectedFields(query string) ([]string, error) {
+	if query == "" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(query, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := s.queryFields[name]; !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Returns the JSON object of body with only the fields in names, in the order of body.
+// Fields that body leaves out, such as empty omitempty ones, stay left out.
+func selectFields(body any, names []string) (json.RawMessage, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil { // {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(names, key.(string)) {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(raw)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,248 @@
+package p0f
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A body format of the query endpoints, selected with the format query parameter
+// (example: http://localhost:38749/?format=csv) or the Accept header.
+type responseFormat struct {
+	name      string
+	mediaType string
+	// Writes body, a value encoding to a JSON object. pretty is set by the p query parameter.
+	encode func(w io.Writer, body any, pretty bool) error
+}
+
+// The supported formats. JSON comes first, it is the default.
+var responseFormats = []responseFormat{
+	{"json", "application/json", encodeJSON},
+	{"csv", "text/csv", encodeCSV},
+	{"text", "text/plain", encodeText},
+	{"xml", "application/xml", encodeXML},
+}
+
+func formatNames() []string {
+	names := make([]string, len(responseFormats))
+	for i, f := range responseFormats {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Selects the format of the response to r, from the format query parameter if present, otherwise
+// from the Accept header. JSON is used whenever it is acceptable, including for "*/*" and without
+// an Accept header, so browsers and existing clients keep getting JSON. Otherwise the acceptable
+// format with the highest quality is used. false is returned if no supported format is acceptable.
+func negotiateFormat(r *http.Request) (responseFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range responseFormats {
+			if f.name == name {
+				return f, true
+			}
+		}
+		return responseFormat{}, false
+	}
+
+	return acceptedFormat(r.Header.Get("Accept"), responseFormats)
+}
+
+// Selects the format of formats acceptable in the Accept header accept, preferring the first
+// whenever it is acceptable, otherwise the one with the highest quality. The first is used
+// without an Accept header. false is returned if none of formats is acceptable.
+func acceptedFormat(accept string, formats []responseFormat) (responseFormat, bool) {
+	if accept == "" {
+		return formats[0], true
+	}
+	best, bestQ := -1, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		for i, f := range formats {
+			if !matchesMediaRange(f.mediaType, mediaType) {
+				continue
+			}
+			if i == 0 {
+				return f, true
+			}
+			if q > bestQ {
+				best, bestQ = i, q
+			}
+		}
+	}
+	if best < 0 {
+		return responseFormat{}, false
+	}
+	return formats[best], true
+}
+
+// Reports whether mediaType is matched by mediaRange, such as "text/csv", "text/*" or "*/*".
+func matchesMediaRange(mediaType, mediaRange string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(mediaRange, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// Writes body in the format negotiated for r, or 406 Not Acceptable.
+func (s *httpServer) writeBody(w http.ResponseWriter, r *http.Request, body any) {
+	w.Header().Add("Vary", "Accept")
+	format, ok := negotiateFormat(r)
+	if !ok {
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return
+	}
+	// Validated by resolveIP
+	if names, _ := s.selectedFields(r.URL.Query().Get("fields")); names != nil {
+		selected, err := selectFields(body, names)
+		if err != nil {
+			s.log.Printf("response encode error: %s\n", err.Error())
+			http.Error(w, "query error", http.StatusInternalServerError)
+			return
+		}
+		body = selected
+	}
+	w.Header().Set("Content-Type", format.mediaType+"; charset=UTF-8")
+	// Pretty print (example: http://localhost:38749/?p=1)
+	if err := format.encode(w, body, r.URL.Query().Has("p")); err != nil {
+		s.log.Printf("response encode error: %s\n", err.Error())
+	}
+}
+
+func encodeJSON(w io.Writer, body any, pretty bool) error {
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", " ")
+	}
+	return enc.Encode(body)
+}
+
+// Writes a header row with the field names and a row with their values.
+// Arrays are joined with ";".
+func encodeCSV(w io.Writer, body any, pretty bool) error {
+	fields, err := bodyFields(body)
+	if err != nil {
+		return err
+	}
+	names, values := make([]string, len(fields)), make([]string, len(fields))
+	for i, f := range fields {
+		names[i], values[i] = f.name, strings.Join(f.values, ";")
+	}
+	cw := csv.NewWriter(w)
+	cw.WriteAll([][]string{names, values})
+	return cw.Error()
+}
+
+// Writes a "name: value" line for each field. Arrays are joined with ", ".
+func encodeText(w io.Writer, body any, pretty bool) error {
+	fields, err := bodyFields(body)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, f := range fields {
+		fmt.Fprintf(&buf, "%s: %s\n", f.name, strings.Join(f.values, ", "))
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Writes a <response> element with an element for each field.
+// Arrays become one element per item, and null fields are left out.
+func encodeXML(w io.Writer, body any, pretty bool) error {
+	fields, err := bodyFields(body)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if pretty {
+		enc.Indent("", " ")
+	}
+	root := xml.StartElement{Name: xml.Name{Local: "response"}}
+	enc.EncodeToken(root)
+	for _, f := range fields {
+		for _, v := range f.values {
+			enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: f.name}})
+		}
+	}
+	enc.EncodeToken(root.End())
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// A field of a response body in text form.
+type bodyField struct {
+	name   string
+	values []string // One value for scalars, none for null, one for each item of arrays
+}
+
+// Returns the fields of body in the order of its JSON encoding, so all formats
+// have the same fields as the JSON one, including those added or shadowed by HttpOptions.
+func bodyFields(body any) ([]bodyField, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil { // {
+		return nil, err
+	}
+	var fields []bodyField
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			items = []json.RawMessage{raw}
+		}
+		field := bodyField{name: key.(string), values: []string{}}
+		for _, item := range items {
+			if v, ok := jsonScalar(item); ok {
+				field.values = append(field.values, v)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Returns the text form of a JSON scalar, false for null.
+func jsonScalar(raw json.RawMessage) (string, bool) {
+	if string(raw) == "null" {
+		return "", false
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, true
+	}
+	return string(raw), true
+}
@@ -0,0 +1,120 @@
+package p0f
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Reports whether r advertises gzip in its Accept-Encoding header, with a quality above 0.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if name = strings.TrimSpace(name); name != "gzip" && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
+
+// ResponseWriter compressing the body with gzip once it reaches minSize bytes, see WithGzip.
+// The body is buffered until then, and smaller bodies are written uncompressed when closed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	code    int // Status code to write, 200 if WriteHeader was not called
+	buf     []byte
+	decided bool         // Set once the headers were written
+	gz      *gzip.Writer // nil if writing uncompressed
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, minSize int) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w, minSize: minSize, code: http.StatusOK}
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.code = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		w.decide(true)
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Writes buffered data so far, compressed if the body reached minSize, for streaming responses.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.minSize)
+		w.flushBuffer()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Writes the headers, compressing the body if compress is set and the response may be compressed.
+func (w *gzipResponseWriter) decide(compress bool) {
+	w.decided = true
+	h := w.Header()
+	if compress && h.Get("Content-Encoding") == "" && w.code != http.StatusNoContent && w.code != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+func (w *gzipResponseWriter) flushBuffer() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Writes what is left of the response. Bodies smaller than minSize are written uncompressed.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		w.decide(false)
+		w.flushBuffer()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
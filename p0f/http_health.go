@@ -0,0 +1,47 @@
+package p0f
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Longest time a readiness probe waits for p0f.
+const readinessTimeout = 2 * time.Second
+
+// Queried by readiness probes. p0f never sees traffic from it, so a no match answer is expected.
+var probeIP = net.IPv4(127, 0, 0, 1)
+
+// Reports whether r is for one of the health check endpoints, if enabled.
+func (s *httpServer) healthCheck(r *http.Request) bool {
+	return s.cfg.healthChecks && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz")
+}
+
+// Handles a liveness check (example: http://localhost:38749/healthz).
+// Answers 200 OK until the P0f instance is shut down, and 503 Service Unavailable after.
+func (s *httpServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if s.p.shutdown.Load() {
+		http.Error(w, "shut down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Handles a readiness check (example: http://localhost:38749/readyz).
+// Sends a probe query to p0f, bypassing the cache, and answers 200 OK if a valid response
+// frame came back, whatever its result, and 503 Service Unavailable otherwise.
+func (s *httpServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	_, err := s.p.query(ctx, probeIP)
+	if err != nil && !errors.Is(err, ErrNoMatch) && !errors.Is(err, ErrBadQuery) {
+		s.log.Printf("readiness probe failed: %s\n", err.Error())
+		http.Error(w, "p0f unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
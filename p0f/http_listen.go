@@ -0,0 +1,60 @@
+package p0f
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Opens the listener of server: the unix socket set by WithUnixListener,
+// otherwise TCP on server.Addr.
+func (s *httpServer) listen(server *http.Server) (net.Listener, error) {
+	path := s.cfg.listenSocket
+	if path == "" {
+		return net.Listen("tcp", server.Addr)
+	}
+	if strings.HasPrefix(path, "@") {
+		// Linux abstract socket: there is no file to remove or chmod
+		return net.Listen("unix", path)
+	}
+	// Remove the socket of a previous run, which was not unlinked if it crashed.
+	// Other files are left alone, listening then fails.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, s.cfg.listenSocketMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("chmod %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Returns where server listens, for logging.
+func (s *httpServer) listenAddr(server *http.Server) string {
+	if s.cfg.listenSocket != "" {
+		return "unix:" + s.cfg.listenSocket
+	}
+	return server.Addr
+}
+
+// Listens and serves requests on server until it fails or is shut down,
+// over TLS if WithTLS is used.
+func (s *httpServer) listenAndServe(server *http.Server) error {
+	l, err := s.listen(server)
+	if err != nil {
+		return err
+	}
+	if server.TLSConfig != nil {
+		// The certificates are in TLSConfig
+		return server.ServeTLS(l, "", "")
+	}
+	return server.Serve(l)
+}
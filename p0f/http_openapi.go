@@ -0,0 +1,294 @@
+package p0f
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Handles a request for the OpenAPI 3 description of the enabled endpoints
+// (example: http://localhost:38749/openapi.json)
+func (s *httpServer) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Has("p") {
+		enc.SetIndent("", " ")
+	}
+	if err := enc.Encode(s.openAPISpec()); err != nil {
+		s.log.Printf("openapi encode error: %s\n", err.Error())
+	}
+}
+
+type object = map[string]any
+
+// Builds the OpenAPI document for the endpoints and response format of s.
+// Response schemas are generated from the Go types, so they follow changes to P0fResponse.
+func (s *httpServer) openAPISpec() object {
+	query := s.querySchema()
+	pretty := object{
+		"name": "p", "in": "query", "allowEmptyValue": true, "schema": object{"type": "string"},
+		"description": "Pretty print the JSON response",
+	}
+	nocache := object{
+		"name": "nocache", "in": "query", "allowEmptyValue": true, "schema": object{"type": "string"},
+		"description": "Query p0f even if a cached response is available",
+	}
+	format := object{
+		"name": "format", "in": "query", "schema": object{"type": "string", "enum": formatNames()},
+		"description": "Format of the response, overriding the Accept header",
+	}
+	fields := object{
+		"name": "fields", "in": "query", "style": "form", "explode": false,
+		"schema":      object{"type": "array", "items": object{"type": "string", "enum": slices.Sorted(maps.Keys(query["properties"].(object)))}},
+		"description": "Comma separated fields to return, others are left out. Unknown fields are answered with 400",
+	}
+	timeFormat := object{
+		"name": "time", "in": "query", "schema": object{"type": "string", "enum": timestampFormatNames},
+		"description": "Encoding of the unix time fields, overriding the configured one. The schema of the response assumes the configured one",
+	}
+	text := func(description string) object {
+		return object{"description": description, "content": object{"text/plain": object{"schema": object{"type": "string"}}}}
+	}
+	errorResponses := object{
+		"400": text("The client address could not be parsed, or fields or time has an unknown value"),
+		"405": text("Method not allowed"),
+		"429": text("p0f is saturated or the rate limit is exceeded, retry after the number of seconds in Retry-After"),
+		"500": text("p0f could not be queried"),
+		"503": text("Overloaded or shutting down, retry after the number of seconds in Retry-After"),
+	}
+	if s.cfg.auth != nil {
+		errorResponses["401"] = text("Unauthorized")
+	}
+	withErrors := func(responses object) object {
+		for code, response := range errorResponses {
+			if _, ok := responses[code]; !ok {
+				responses[code] = response
+			}
+		}
+		return responses
+	}
+	jsonContent := func(schema object) object {
+		return object{"application/json": object{"schema": schema}}
+	}
+
+	// The other formats are derived from the fields of the JSON one
+	queryContent := jsonContent(query)
+	for _, f := range responseFormats[1:] {
+		queryContent[f.mediaType] = object{"schema": object{"type": "string"}}
+	}
+
+	paths := object{
+		"/": object{"get": object{
+			"summary":     "Fingerprint the connecting client",
+			"operationId": "query",
+			"parameters":  []object{pretty, nocache, format, fields, timeFormat},
+			"responses": withErrors(object{
+				"200": object{"description": "p0f has a match for the client", "content": queryContent},
+				"404": text("p0f has no match for the client, or the match quality is below the configured minimum"),
+				"406": text("None of the supported formats is acceptable"),
+			}),
+		}},
+	}
+	if len(s.cfg.allowIPs) > 0 || len(s.cfg.denyIPs) > 0 {
+		paths["/"].(object)["get"].(object)["responses"].(object)["204"] = object{"description": "The client is excluded from fingerprinting"}
+	}
+	if s.cfg.longPollTimeout > 0 {
+		paths["/poll"] = object{"get": object{
+			"summary":     "Fingerprint the connecting client, waiting for p0f to have a match",
+			"operationId": "poll",
+			"parameters":  []object{pretty, nocache, format, fields, timeFormat},
+			"responses": withErrors(object{
+				"200": object{"description": "p0f has a match for the client", "content": queryContent},
+				"204": object{"description": "p0f has no match for the client before the timeout"},
+				"406": text("None of the supported formats is acceptable"),
+			}),
+		}}
+	}
+	if s.cfg.streamInterval > 0 {
+		paths["/stream"] = object{"get": object{
+			"summary":     "Fingerprint the connecting client repeatedly, until it disconnects",
+			"operationId": "stream",
+			"parameters":  []object{nocache, fields, timeFormat},
+			"responses": withErrors(object{
+				"200": object{
+					"description": `One JSON object per line: the query response, or {"error": "no match"} or {"error": "query error"}`,
+					"content":     object{ndjsonMediaType: object{"schema": object{"type": "string"}}},
+				},
+			}),
+		}}
+	}
+	if s.cfg.batchMaxIPs > 0 {
+		paths["/batch"] = object{"post": object{
+			"summary":     "Fingerprint a list of IP addresses",
+			"operationId": "batch",
+			"parameters":  []object{pretty},
+			"requestBody": object{"required": true, "content": jsonContent(object{
+				"type": "array", "items": object{"type": "string"}, "maxItems": s.cfg.batchMaxIPs,
+			})},
+			"responses": withErrors(object{
+				"200": object{"description": "Results in the order of the request", "content": jsonContent(object{
+					"type": "array", "items": schemaOf(reflect.TypeOf(batchResult{})),
+				})},
+				"400": text("The body is not a JSON array of IP addresses"),
+				"406": text("JSON is not acceptable"),
+				"413": text("The body or the number of IP addresses is too large, or over the rate limit burst"),
+			}),
+		}}
+	}
+	if s.cfg.healthChecks {
+		paths["/healthz"] = object{"get": object{
+			"summary":     "Liveness check",
+			"operationId": "healthz",
+			"security":    []object{}, // Not subject to WithAuth
+			"responses":   object{"200": text("Alive"), "503": text("Shut down")},
+		}}
+		paths["/readyz"] = object{"get": object{
+			"summary":     "Readiness check, answered once p0f answered a probe query",
+			"operationId": "readyz",
+			"security":    []object{},
+			"responses":   object{"200": text("p0f is reachable"), "503": text("p0f is unavailable")},
+		}}
+	}
+	if s.cfg.stats {
+		paths["/stats"] = object{"get": object{
+			"summary":     "Counters of the p0f client",
+			"operationId": "stats",
+			"parameters":  []object{pretty},
+			"responses": object{
+				"200": object{"description": "Stats", "content": jsonContent(schemaOf(reflect.TypeOf(Stats{})))},
+			},
+		}}
+	}
+	if s.cfg.metrics {
+		paths["/metrics"] = object{"get": object{
+			"summary":     "Counters of the p0f client in the Prometheus text format",
+			"operationId": "metrics",
+			"responses": object{
+				"200": object{"description": "Metrics", "content": object{"text/plain": object{"schema": object{"type": "string"}}}},
+			},
+		}}
+	}
+
+	paths["/openapi.json"] = object{"get": object{
+		"summary":     "This OpenAPI description",
+		"operationId": "openapi",
+		"parameters":  []object{pretty},
+		"responses": object{
+			"200": object{"description": "OpenAPI 3 document", "content": jsonContent(object{"type": "object"})},
+		},
+	}}
+
+	spec := object{
+		"openapi": "3.0.3",
+		"info":    object{"title": "p0f-go", "version": "1"},
+		"paths":   paths,
+	}
+	if s.cfg.auth != nil {
+		// The validator is opaque, so the scheme of APIKeyAuth is described
+		spec["components"] = object{"securitySchemes": object{
+			"bearer": object{"type": "http", "scheme": "bearer"},
+			"apiKey": object{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+		}}
+		spec["security"] = []object{{"bearer": []string{}}, {"apiKey": []string{}}}
+	}
+	return spec
+}
+
+// Returns the schema of the query response body, which depends on the configured HttpOptions.
+func (s *httpServer) querySchema() object {
+	schema := schemaOf(reflect.TypeOf(httpResponse{}))
+	properties := schema["properties"].(object)
+	if !s.cfg.deviceType {
+		delete(properties, "deviceType")
+		delete(properties, "deviceTypeConfident")
+	}
+	if !s.cfg.distinctOsCount {
+		delete(properties, "distinctOsCount")
+	}
+	if !s.cfg.devPlaceholder {
+		delete(properties, "placeholder")
+	}
+	if !s.cfg.queryMetadata {
+		delete(properties, "queriedAt")
+		delete(properties, "cached")
+	}
+	var timestamp object
+	switch s.cfg.timestampFormat {
+	case TimestampMillis:
+		timestamp = object{"type": "integer", "format": "int64", "minimum": 0}
+	case TimestampString:
+		timestamp = object{"type": "string", "pattern": "^[0-9]+$"}
+	case TimestampRFC3339:
+		timestamp = object{"type": "string", "format": "date-time", "nullable": true}
+	}
+	if timestamp != nil {
+		for _, name := range []string{"firstSeen", "lastSeen", "lastNat", "lastChg", "queriedAt"} {
+			if _, ok := properties[name]; ok {
+				properties[name] = timestamp
+			}
+		}
+	}
+	return schema
+}
+
+// Generates the JSON schema of values of t, as encoded by encoding/json.
+// Fields of embedded structs are flattened, fields without omitempty are required.
+func schemaOf(t reflect.Type) object {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaOf(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer", "minimum": 0}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.Slice:
+		return object{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties, required := object{}, []string{}
+		addStructFields(t, properties, &required)
+		schema := object{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return object{}
+	}
+}
+
+func addStructFields(t reflect.Type, properties object, required *[]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addStructFields(field.Type, properties, required)
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
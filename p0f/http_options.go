@@ -0,0 +1,413 @@
+package p0f
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultMaxHeaderBytes = 32 << 10
+	defaultMaxBodyBytes   = 1 << 20
+)
+
+// HttpOption configures the HTTP server, see ServeHttp.
+type HttpOption func(*httpConfig)
+
+// Returns the default configuration with opts applied.
+func newHttpConfig(opts []HttpOption) httpConfig {
+	c := httpConfig{
+		maxHeaderBytes: defaultMaxHeaderBytes,
+		maxBodyBytes:   defaultMaxBodyBytes,
+		logger:         log.New(os.Stdout, "[p0f-web-server]", log.Ldate|log.Ltime|log.Lmsgprefix),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+type httpConfig struct {
+	shedHigh     int
+	shedLow      int
+	shedFraction float64
+
+	longPollTimeout time.Duration
+
+	batchMaxIPs int
+
+	deviceType bool
+
+	distinctOsCount bool
+
+	minMatchQuality MatchQuality
+
+	timestampFormat TimestampFormat
+
+	maxHeaderBytes int
+	maxBodyBytes   int64
+
+	backpressure float64
+
+	openAPI bool
+
+	metrics bool
+
+	stats bool
+
+	healthChecks bool
+
+	devPlaceholder bool
+
+	fingerprintCookie *http.Cookie
+
+	logger Logger
+
+	allowIPs []net.IPNet
+	denyIPs  []net.IPNet
+
+	rateLimit        float64
+	rateBurst        int
+	clientRateLimit  float64
+	clientRateBurst  int
+	rateLimitClients int
+
+	corsOrigins []string
+
+	bindAddress string
+
+	listenSocket     string
+	listenSocketMode os.FileMode
+
+	tlsConfig *tls.Config
+
+	auth func(r *http.Request) bool
+
+	gzip        bool
+	gzipMinSize int
+
+	queryMetadata bool
+
+	streamInterval time.Duration
+}
+
+// Reports whether ip may be fingerprinted, see WithIPFilter.
+func (c *httpConfig) ipPermitted(ip net.IP) bool {
+	if len(c.allowIPs) > 0 && !inNetworks(ip, c.allowIPs) {
+		return false
+	}
+	return !inNetworks(ip, c.denyIPs)
+}
+
+// Rejects queries with 503 Service Unavailable while the p0f request queue is overloaded.
+//
+// Shedding starts when the queue holds high or more requests, and continues until
+// it has drained to low or fewer. While shedding, each query is rejected
+// with probability fraction (0 to 1), so 1 rejects all of them.
+//
+// Values of high that are not positive disable load shedding.
+// A low above high is lowered to high, and fraction is clamped to the 0 to 1 range.
+func WithLoadShedding(high, low int, fraction float64) HttpOption {
+	return func(c *httpConfig) {
+		c.shedHigh, c.shedLow = high, min(low, high)
+		c.shedFraction = max(0, min(fraction, 1))
+	}
+}
+
+// Serves a long-poll endpoint at /poll, which holds the request for up to timeout
+// until p0f has a match for the client. This gives clients a definitive answer
+// in a single request right after their first connection, when p0f has not seen
+// enough packets yet. 204 No Content is returned if there is still no match at the timeout.
+func WithLongPoll(timeout time.Duration) HttpOption {
+	return func(c *httpConfig) {
+		c.longPollTimeout = timeout
+	}
+}
+
+// Serves a streaming endpoint at /stream, which queries p0f for the client every interval
+// and writes each result as a line of NDJSON, until the client disconnects.
+// This lets dashboards watch the verdict for a client sharpen over its connections
+// with a single request. Each line is a query to p0f unless WithCache answers it.
+func WithStream(interval time.Duration) HttpOption {
+	return func(c *httpConfig) {
+		c.streamInterval = interval
+	}
+}
+
+// Serves a batch endpoint at /batch, which accepts a POST with a JSON array of
+// up to maxIPs IP addresses and returns the result for each of them as a JSON array.
+//
+// Unlike the other endpoints, this fingerprints arbitrary addresses
+// rather than the connecting client, so only enable it for trusted callers.
+func WithBatch(maxIPs int) HttpOption {
+	return func(c *httpConfig) {
+		c.batchMaxIPs = maxIPs
+	}
+}
+
+// Adds the deviceType and deviceTypeConfident fields to query responses,
+// see P0fResponse.DeviceTypeGuess.
+func WithDeviceType() HttpOption {
+	return func(c *httpConfig) {
+		c.deviceType = true
+	}
+}
+
+// Adds the distinctOsCount field to query responses, the number of distinct OS names
+// seen for the client, see P0f.DistinctOSCount. The P0f instance must use WithOSHistory.
+// The count is derived by this server rather than reported by p0f, and is best-effort.
+func WithDistinctOSCount() HttpOption {
+	return func(c *httpConfig) {
+		c.distinctOsCount = true
+	}
+}
+
+// Adds the queriedAt and cached fields to query responses: when p0f answered,
+// in the configured TimestampFormat, and whether the response was served from the cache
+// of WithCache. For cached responses, queriedAt is when p0f answered the query that was cached.
+func WithQueryMetadata() HttpOption {
+	return func(c *httpConfig) {
+		c.queryMetadata = true
+	}
+}
+
+// Answers 404 Not Found, the same as for a no match result, when the OS match
+// of a response is worse than min. Use this when low confidence results
+// should not be acted upon. By default all results are returned.
+func WithMinMatchQuality(min MatchQuality) HttpOption {
+	return func(c *httpConfig) {
+		c.minMatchQuality = min
+	}
+}
+
+// Sets how the unix time fields of query responses are encoded, see TimestampFormat.
+// The default is TimestampSeconds. Clients can override it with the time query parameter,
+// one of "unix", "millis", "string" or "rfc3339".
+func WithTimestampFormat(format TimestampFormat) HttpOption {
+	return func(c *httpConfig) {
+		c.timestampFormat = format
+	}
+}
+
+// Listens on host only, such as "127.0.0.1" or the address of a management interface,
+// rather than on all interfaces. The port is the one passed to the function starting the server.
+// This only applies to servers started by this package.
+func WithBindAddress(host string) HttpOption {
+	return func(c *httpConfig) {
+		c.bindAddress = host
+	}
+}
+
+// Listens on a unix socket at path rather than on TCP, so only processes on the same host
+// with access to path can reach the server. The port passed to the function starting the server
+// is then unused. A socket left at path by a previous run is removed first,
+// and the socket is given the permissions mode, such as 0660.
+// A path starting with @ is a Linux abstract socket, which has no file and ignores mode.
+// This only applies to servers started by this package.
+//
+// Requests over a unix socket have no client address, so ipResolver must get it
+// from elsewhere, such as ForwardedForResolver behind a proxy on the same host.
+func WithUnixListener(path string, mode os.FileMode) HttpOption {
+	return func(c *httpConfig) {
+		c.listenSocket, c.listenSocketMode = path, mode
+	}
+}
+
+// Serves HTTPS rather than HTTP, using config, which must have a certificate
+// in Certificates or GetCertificate. Use LoadTLSConfig for a certificate and key file pair,
+// or the TLSConfig of golang.org/x/crypto/acme/autocert for Let's Encrypt certificates.
+// This only applies to servers started by this package, including the graceful shutdown variants.
+func WithTLS(config *tls.Config) HttpOption {
+	return func(c *httpConfig) {
+		c.tlsConfig = config
+	}
+}
+
+// Returns a TLS configuration for WithTLS serving the PEM encoded certificate and key
+// in certFile and keyFile. The certificate file may hold the intermediate certificates after it.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Limits the size of request headers the server reads, including the request line.
+// Requests with larger headers are answered with 431 Request Header Fields Too Large.
+// The default is 32 KiB.
+func WithMaxHeaderBytes(n int) HttpOption {
+	return func(c *httpConfig) {
+		c.maxHeaderBytes = n
+	}
+}
+
+// Limits the size of request bodies accepted by the batch endpoint.
+// Larger bodies are answered with 413 Request Entity Too Large.
+// The default is 1 MiB.
+func WithMaxBodyBytes(n int64) HttpOption {
+	return func(c *httpConfig) {
+		c.maxBodyBytes = n
+	}
+}
+
+// Compresses response bodies of minSize bytes or more with gzip for clients
+// advertising it in Accept-Encoding. Smaller bodies are sent uncompressed,
+// as compression would not make them meaningfully smaller.
+func WithGzip(minSize int) HttpOption {
+	return func(c *httpConfig) {
+		c.gzip, c.gzipMinSize = true, minSize
+	}
+}
+
+// Answers 429 Too Many Requests once the p0f request queue is filled to threshold
+// (a fraction of its capacity, between 0 and 1), so clients back off before it overflows.
+// The Retry-After header is the estimated time for p0f to drain the queue,
+// derived from the current queue length and average round trip time.
+//
+// Unlike WithLoadShedding, every request is rejected while above the threshold.
+func WithBackpressure(threshold float64) HttpOption {
+	return func(c *httpConfig) {
+		c.backpressure = threshold
+	}
+}
+
+// Serves an OpenAPI 3 description of the enabled endpoints at /openapi.json,
+// for generating client SDKs. The response schemas reflect the other HttpOptions,
+// such as WithTimestampFormat and WithDeviceType.
+func WithOpenAPI() HttpOption {
+	return func(c *httpConfig) {
+		c.openAPI = true
+	}
+}
+
+// Serves the counters of the P0f instance at /metrics in the Prometheus text format,
+// see P0f.WriteMetrics.
+func WithMetrics() HttpOption {
+	return func(c *httpConfig) {
+		c.metrics = true
+	}
+}
+
+// Serves the Stats of the P0f instance at /stats as JSON, for a quick look at its counters
+// without a metrics system.
+func WithStatsEndpoint() HttpOption {
+	return func(c *httpConfig) {
+		c.stats = true
+	}
+}
+
+// Restricts which clients are fingerprinted. If allow is not empty, only addresses within
+// one of its networks are queried, and addresses within one of the deny networks never are,
+// see PrivateNetworks. Queries for other clients are answered with 204 No Content without
+// querying p0f, and batch results for other addresses have the error "filtered".
+//
+// This takes precedence over WithDevPlaceholder.
+func WithIPFilter(allow, deny []net.IPNet) HttpOption {
+	return func(c *httpConfig) {
+		c.allowIPs, c.denyIPs = allow, deny
+	}
+}
+
+// Limits the rate of queries served, across all clients, to rate per second
+// with bursts of up to burst queries. Queries over the limit are answered with
+// 429 Too Many Requests without querying p0f, with a Retry-After header.
+//
+// This applies to the query endpoints (/ and /poll) and to /batch, which takes a token for each
+// address it queries. A batch of more addresses than burst is answered with 413 Content Too Large.
+// The other endpoints are not limited. Values of rate or burst that are not positive disable the limit.
+func WithRateLimit(rate float64, burst int) HttpOption {
+	return func(c *httpConfig) {
+		c.rateLimit, c.rateBurst = rate, burst
+	}
+}
+
+// Same as WithRateLimit, but limits each client address separately, as resolved by the ipResolver.
+// Buckets are kept for the maxClients most recently seen addresses. Older ones are forgotten,
+// and start with a full bucket when seen again, so spoofed addresses cannot grow memory unbounded.
+//
+// Both limits may be used together, a query must then be within both.
+// A query refused by one limit takes no token from the other.
+func WithClientRateLimit(rate float64, burst, maxClients int) HttpOption {
+	return func(c *httpConfig) {
+		c.clientRateLimit, c.clientRateBurst, c.rateLimitClients = rate, burst, maxClients
+	}
+}
+
+// Allows browsers to call the endpoints with fetch() from pages of allowedOrigins,
+// such as "https://example.com", by sending the CORS headers. The Origin of each request
+// is checked against allowedOrigins and echoed back if listed, "*" allows any origin.
+// Preflight OPTIONS requests are answered with 204 No Content.
+//
+// Responses to requests from other origins have no CORS headers, so browsers do not expose them.
+func WithCORS(allowedOrigins []string) HttpOption {
+	return func(c *httpConfig) {
+		c.corsOrigins = allowedOrigins
+	}
+}
+
+// Answers 401 Unauthorized, without querying p0f, to requests for which validate returns false,
+// such as those without a valid API key with APIKeyAuth. By default all requests are served.
+//
+// This applies to all endpoints except the health checks of WithHealthChecks, which load balancers
+// call without credentials, and CORS preflight requests, which browsers send without credentials.
+func WithAuth(validate func(r *http.Request) bool) HttpOption {
+	return func(c *httpConfig) {
+		c.auth = validate
+	}
+}
+
+// Serves health checks for load balancers and orchestrators. /healthz is the liveness check,
+// answering 200 OK until the P0f instance is shut down. /readyz is the readiness check,
+// answering 200 OK only if p0f answers a probe query over the socket.
+// Both answer 503 Service Unavailable when failing.
+//
+// Readiness probes are counted in Stats like other queries.
+func WithHealthChecks() HttpOption {
+	return func(c *httpConfig) {
+		c.healthChecks = true
+	}
+}
+
+// Sets a cookie holding P0fResponse.Fingerprint on successful query responses,
+// so later page loads of the same browser can be correlated by the cookie
+// without querying again.
+//
+// cookie is the template of the cookie set: its Name, Path, Domain, MaxAge, Expires,
+// HttpOnly, Secure and SameSite are used as given, and its Value is replaced by the fingerprint.
+// A cookie without a Name disables this.
+func WithFingerprintCookie(cookie http.Cookie) HttpOption {
+	return func(c *httpConfig) {
+		if cookie.Name == "" {
+			c.fingerprintCookie = nil
+			return
+		}
+		c.fingerprintCookie = &cookie
+	}
+}
+
+// Answers 200 OK with a placeholder response, rather than an error, when a query for a
+// loopback, private or link-local client fails. p0f never sees those clients in local
+// development, so this keeps frontend code working there. The placeholder has
+// "placeholder": true and no fingerprint data.
+//
+// This is meant for development only, and should not be enabled in production.
+func WithDevPlaceholder() HttpOption {
+	return func(c *httpConfig) {
+		c.devPlaceholder = true
+	}
+}
+
+// Sets the logger for the requests and errors logged by the HTTP server,
+// such as its start and stop and bad client addresses. The default logs to stdout
+// with the "[p0f-web-server]" prefix. A nil logger is ignored.
+func WithServerLogger(logger Logger) HttpOption {
+	return func(c *httpConfig) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
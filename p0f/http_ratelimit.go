@@ -0,0 +1,110 @@
+package p0f
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// LRU of the token buckets of each client, keyed by IP string, see WithClientRateLimit.
+type clientLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+type clientLimiterEntry struct {
+	key    string
+	bucket *tokenBucket
+}
+
+func newClientLimiter(rate float64, burst, maxClients int) *clientLimiter {
+	return &clientLimiter{
+		rate:    rate,
+		burst:   burst,
+		max:     maxClients,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Returns the bucket of key, creating it if needed. A nil limiter returns a nil bucket.
+func (l *clientLimiter) bucket(key string) *tokenBucket {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		elem = l.lru.PushFront(&clientLimiterEntry{key: key, bucket: newTokenBucket(l.rate, l.burst)})
+		l.entries[key] = elem
+		if l.lru.Len() > l.max {
+			back := l.lru.Back()
+			l.lru.Remove(back)
+			delete(l.entries, back.Value.(*clientLimiterEntry).key)
+		}
+	}
+	l.lru.MoveToFront(elem)
+	return elem.Value.(*clientLimiterEntry).bucket
+}
+
+// Creates the buckets of the rate limits configured by WithRateLimit and WithClientRateLimit.
+func (s *httpServer) initRateLimits() {
+	if s.cfg.rateLimit > 0 && s.cfg.rateBurst > 0 {
+		s.rateLimit = newTokenBucket(s.cfg.rateLimit, s.cfg.rateBurst)
+	}
+	if s.cfg.clientRateLimit > 0 && s.cfg.clientRateBurst > 0 && s.cfg.rateLimitClients > 0 {
+		s.clientLimits = newClientLimiter(s.cfg.clientRateLimit, s.cfg.clientRateBurst, s.cfg.rateLimitClients)
+	}
+}
+
+// Returns the key of the client of r in the per client rate limit, its IP as resolved by the ipResolver.
+func (s *httpServer) clientKey(r *http.Request) string {
+	addr := s.ipResolver(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// Takes a token for a query from key, the client IP string, answering 429 Too Many Requests
+// if either rate limit is exceeded. If false is returned, the response has already been written.
+func (s *httpServer) allowQuery(w http.ResponseWriter, key string) bool {
+	return s.allowQueries(w, key, 1)
+}
+
+// Same as allowQuery, for n queries at once. No token is taken unless both limits have n,
+// and a request of more queries than either burst is answered with 413 Content Too Large.
+//
+// The client limit is checked first, so a single noisy client does not drain the global bucket.
+func (s *httpServer) allowQueries(w http.ResponseWriter, key string, n int) bool {
+	client := s.clientLimits.bucket(key)
+	if !client.holds(n) || !s.rateLimit.holds(n) {
+		http.Error(w, "more queries than the rate limit allows at once", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	ok, wait := client.takeN(n)
+	if ok {
+		if ok, wait = s.rateLimit.takeN(n); !ok {
+			// Refused by the global limit, the client did not spend its tokens
+			client.putBack(n)
+		}
+	}
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
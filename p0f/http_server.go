@@ -1,12 +1,24 @@
 package p0f
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
-	"os"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long the long-poll endpoint waits between retries of a no match query
+	longPollInterval = 250 * time.Millisecond
+
+	// How long a graceful shutdown waits for queries in progress
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
@@ -20,7 +32,8 @@ var (
 // StartHttpWebServer
 //
 // Starts the web server that creates a p0f instance with the given sockFile.
-// It listens to HTTP queries on the given port and
+// It listens to HTTP queries on the given port, on all interfaces
+// unless WithBindAddress or WithUnixListener is used, and
 // uses ipResolver to determine what IP address is queried.
 //
 // For ipResolver, you should use DefaultIpResolver in almost all cases,
@@ -34,58 +47,467 @@ var (
 // and the function blocks until an error occurs.
 //
 // The error returned is always non-nil.
-func StartHttpWebServer(sockFile string, port int, ipResolver func(r *http.Request) string) error {
+func StartHttpWebServer(sockFile string, port int, ipResolver func(r *http.Request) string, opts ...HttpOption) error {
 	p, err := New(sockFile)
 	if err != nil {
 		return err
 	}
-	log := log.New(os.Stdout, "[p0f-web-server]", log.Ldate|log.Ltime|log.Lmsgprefix)
-	log.Printf("started with sock '%s' on port %d\n", sockFile, port)
+	return ServeHttp(p, port, ipResolver, opts...)
+}
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ipString := ipResolver(r)
+// ServeHttp
+//
+// Same as StartHttpWebServer, but serves queries using an existing p0f instance.
+// This allows the caller to keep a reference to p, for example to read its Stats
+// or to Reconnect it while the server is running.
+//
+// The function blocks until an error occurs.
+// The error returned is always non-nil.
+func ServeHttp(p *P0f, port int, ipResolver func(r *http.Request) string, opts ...HttpOption) error {
+	s := newHttpServer(p, ipResolver, opts)
+	server := s.newServer(port)
+	s.log.Printf("started with sock '%s' on %s\n", p.sockFile, s.listenAddr(server))
+	return s.listenAndServe(server)
+}
 
-		// Ensures that a new connection is attempted every time by a browser,
-		// which results in faster verdict changes
-		w.Header().Set("Connection", "close")
+// StartHttpWebServerContext
+//
+// Same as StartHttpWebServer, but shuts down gracefully once ctx is done:
+// the server stops accepting connections, waits up to shutdownTimeout for queries
+// in progress to be answered, and then shuts down the p0f instance.
+//
+// nil is returned after a clean shutdown, otherwise the error that stopped the server.
+func StartHttpWebServerContext(ctx context.Context, sockFile string, port int, ipResolver func(r *http.Request) string, opts ...HttpOption) error {
+	p, err := New(sockFile)
+	if err != nil {
+		return err
+	}
+	defer p.Shutdown()
+	return ServeHttpContext(ctx, p, port, ipResolver, opts...)
+}
 
-		if r.Method != "GET" {
-			w.Header().Set("Allow", "GET")
-			log.Printf("%s: bad request method %s\n", ipString, r.Method)
-			http.Error(w, "", http.StatusMethodNotAllowed)
-			return
+// ServeHttpContext
+//
+// Same as ServeHttp, but shuts down the server gracefully once ctx is done,
+// see StartHttpWebServerContext. p is not shut down, as it belongs to the caller.
+//
+// nil is returned after a clean shutdown, otherwise the error that stopped the server.
+func ServeHttpContext(ctx context.Context, p *P0f, port int, ipResolver func(r *http.Request) string, opts ...HttpOption) error {
+	s := newHttpServer(p, ipResolver, opts)
+	server := s.newServer(port)
+
+	stopped := make(chan error, 1)
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+		stopped <- server.Shutdown(shutdownCtx)
+	})
+
+	s.log.Printf("started with sock '%s' on %s\n", p.sockFile, s.listenAddr(server))
+	if err := s.listenAndServe(server); err != http.ErrServerClosed {
+		// Not waiting for ctx anymore, a shutdown already running finishes on its own
+		stop()
+		return err
+	}
+	// Handlers are done once Shutdown returns, so every query they made has been answered
+	err := <-stopped
+	s.log.Printf("stopped\n")
+	return err
+}
+
+// NewHandler
+//
+// Returns the handler serving the HTTP API for p, for mounting it in an existing
+// http.ServeMux, wrapping it in middleware or serving it on a custom listener.
+// The endpoints are relative to where the handler is mounted, use http.StripPrefix
+// to mount it below a path.
+//
+// Resolvers relying on the connection, made with ConnResolver, need the
+// http.Server to set ConnContext as its ConnContext. WithMaxHeaderBytes only applies
+// to servers started by this package, set http.Server.MaxHeaderBytes instead.
+func NewHandler(p *P0f, ipResolver func(r *http.Request) string, opts ...HttpOption) http.Handler {
+	return newHttpServer(p, ipResolver, opts)
+}
+
+func newHttpServer(p *P0f, ipResolver func(r *http.Request) string, opts []HttpOption) *httpServer {
+	s := &httpServer{
+		p:          p,
+		ipResolver: ipResolver,
+		cfg:        newHttpConfig(opts),
+	}
+	s.log = s.cfg.logger
+	s.initRateLimits()
+	s.queryFields = s.querySchema()["properties"].(object)
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/", s.serveQuery)
+	if s.cfg.longPollTimeout > 0 {
+		s.mux.HandleFunc("/poll", s.servePoll)
+	}
+	if s.cfg.streamInterval > 0 {
+		s.mux.HandleFunc("/stream", s.serveStream)
+	}
+	if s.cfg.batchMaxIPs > 0 {
+		s.mux.HandleFunc("/batch", s.serveBatch)
+	}
+	if s.cfg.openAPI {
+		s.mux.HandleFunc("/openapi.json", s.serveOpenAPI)
+	}
+	if s.cfg.metrics {
+		s.mux.HandleFunc("/metrics", s.serveMetrics)
+	}
+	if s.cfg.stats {
+		s.mux.HandleFunc("/stats", s.serveStats)
+	}
+	if s.cfg.healthChecks {
+		s.mux.HandleFunc("/healthz", s.serveHealthz)
+		s.mux.HandleFunc("/readyz", s.serveReadyz)
+	}
+	return s
+}
+
+func (s *httpServer) newServer(port int) *http.Server {
+	server := &http.Server{
+		Addr:           net.JoinHostPort(s.cfg.bindAddress, strconv.Itoa(port)),
+		Handler:        s,
+		ConnContext:    ConnContext,
+		MaxHeaderBytes: s.cfg.maxHeaderBytes,
+	}
+	if s.cfg.tlsConfig != nil {
+		// Cloned, as the server adds its own settings for HTTP/2
+		server.TLSConfig = s.cfg.tlsConfig.Clone()
+	}
+	return server
+}
+
+type httpServer struct {
+	p          *P0f
+	ipResolver func(r *http.Request) string
+	cfg        httpConfig
+	log        Logger
+	mux        *http.ServeMux
+	shedding   atomic.Bool // Set while the queue is above the load shedding high-water mark
+
+	rateLimit    *tokenBucket   // See WithRateLimit, nil if disabled
+	clientLimits *clientLimiter // See WithClientRateLimit, nil if disabled
+
+	queryFields object // Names of the fields of query responses, for the fields query parameter
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.gzip {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method != "HEAD" && acceptsGzip(r) {
+			gw := newGzipResponseWriter(w, s.cfg.gzipMinSize)
+			defer gw.close()
+			w = gw
 		}
+	}
+	defer s.recoverPanic(w, r)
+	if len(s.cfg.corsOrigins) > 0 && s.cors(w, r) {
+		return
+	}
+	if !s.healthCheck(r) && !s.authorize(w, r) {
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Recovers from a panic of the handler, logging it and answering 500 Internal Server Error.
+// Without this, net/http would close the connection without a response.
+func (s *httpServer) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		// Deliberately aborted, net/http handles it silently
+		panic(v)
+	}
+	s.log.Printf("%s: panic serving %s: %v\n%s", s.logAddr(r.RemoteAddr), r.URL.Path, v, debug.Stack())
+	// Headers set before the panic, such as Content-Type, do not apply to the error
+	for key := range w.Header() {
+		w.Header().Del(key)
+	}
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
 
-		ip, _, err := net.SplitHostPort(ipString)
-		if err != nil {
-			log.Printf("%s: bad IP: %s\n", ipString, err.Error())
-			http.Error(w, "invalid source address", http.StatusBadRequest)
+// Handles a query for the client IP (example: http://localhost:38749/)
+func (s *httpServer) serveQuery(w http.ResponseWriter, r *http.Request) {
+	userIP, ok := s.resolveIP(w, r, true)
+	if !ok {
+		return
+	}
+
+	response, info, err := s.query(r, userIP)
+	if err != nil && s.placeholder(userIP) {
+		s.writePlaceholder(w, r, userIP)
+		return
+	}
+	if err != nil {
+		s.writeQueryError(w, err)
+		return
+	}
+	if response.MatchQuality() < s.cfg.minMatchQuality {
+		http.Error(w, "no match", http.StatusNotFound)
+		return
+	}
+	s.writeResponse(w, r, userIP, response, info)
+}
+
+// Handles a long-poll query for the client IP (example: http://localhost:38749/poll).
+// Right after a client connects p0f may not have a verdict yet, so no match results
+// (and matches below the minimum match quality) are retried until p0f has a match or the configured timeout expires,
+// in which case 204 No Content is returned.
+func (s *httpServer) servePoll(w http.ResponseWriter, r *http.Request) {
+	userIP, ok := s.resolveIP(w, r, true)
+	if !ok {
+		return
+	}
+
+	timeout := time.NewTimer(s.cfg.longPollTimeout)
+	defer timeout.Stop()
+
+	for {
+		response, info, err := s.query(r, userIP)
+		if err == nil && response.MatchQuality() >= s.cfg.minMatchQuality {
+			s.writeResponse(w, r, userIP, response, info)
 			return
 		}
-
-		userIP := net.ParseIP(ip)
-		if userIP == nil {
-			log.Printf("%s: bad IP: %s\n", ipString, err.Error())
-			http.Error(w, "invalid source address", http.StatusBadRequest)
+		if err != nil && s.placeholder(userIP) {
+			s.writePlaceholder(w, r, userIP)
 			return
 		}
-
-		response, err := p.Query(userIP)
-		if err != nil {
-			log.Printf("query error: %s\n", err.Error())
-			http.Error(w, "query error", http.StatusInternalServerError)
+		if err != nil && err != ErrNoMatch {
+			s.writeQueryError(w, err)
 			return
 		}
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		enc := json.NewEncoder(w)
-
-		// Pretty print (example: http://localhost:38749/?p=1)
-		if r.URL.Query().Has("p") {
-			enc.SetIndent("", " ")
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-time.After(longPollInterval):
 		}
-		if err := enc.Encode(response); err != nil {
-			log.Printf("response encode error: %s\n", err.Error())
+		if !s.p.allowRetry() {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
-	}))
+	}
+}
+
+// Returns addr as it should appear in logs, which is anonymized if WithAnonymizeIP is used.
+func (s *httpServer) logAddr(addr string) string {
+	if !s.p.opts.anonymizeIP {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return AnonymizeIP(ip).String()
+	}
+	return addr
+}
+
+// Queries p0f for ip, bypassing the cache if requested (example: http://localhost:38749/?nocache=1)
+func (s *httpServer) query(r *http.Request, ip net.IP) (P0fResponse, queryInfo, error) {
+	if r.URL.Query().Has("nocache") {
+		response, err := s.p.QueryFreshContext(r.Context(), ip)
+		return response, queryInfo{queried: time.Now()}, err
+	}
+	return s.p.queryContext(r.Context(), ip)
+}
+
+// Performs the checks common to all query endpoints and resolves the IP address to query.
+// The response format is negotiated if negotiate is set, endpoints with a fixed format do not.
+// If false is returned, an error response has already been written.
+func (s *httpServer) resolveIP(w http.ResponseWriter, r *http.Request, negotiate bool) (net.IP, bool) {
+	ipString := s.ipResolver(r)
+
+	// Ensures that a new connection is attempted every time by a browser,
+	// which results in faster verdict changes
+	w.Header().Set("Connection", "close")
+
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		s.log.Printf("%s: bad request method %s\n", s.logAddr(ipString), r.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if _, ok := negotiateFormat(r); negotiate && !ok {
+		// Checked before querying, as the response could not be written anyway
+		w.Header().Add("Vary", "Accept")
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return nil, false
+	}
+	if _, err := s.timestampFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if _, err := s.selectedFields(r.URL.Query().Get("fields")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if s.shed() {
+		s.log.Printf("%s: shedding load, queue length %d\n", s.logAddr(ipString), len(s.p.requestQueue))
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if retryAfter, saturated := s.saturated(); saturated {
+		s.log.Printf("%s: p0f saturated, queue length %d\n", s.logAddr(ipString), len(s.p.requestQueue))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	ip, _, err := net.SplitHostPort(ipString)
+	if err != nil {
+		s.log.Printf("%s: bad IP: %s\n", ipString, err.Error())
+		http.Error(w, "invalid source address", http.StatusBadRequest)
+		return nil, false
+	}
+
+	userIP := net.ParseIP(ip)
+	if userIP == nil {
+		s.log.Printf("%s: bad IP: %q\n", ipString, ip)
+		http.Error(w, "invalid source address", http.StatusBadRequest)
+		return nil, false
+	}
+	if !s.cfg.ipPermitted(userIP) {
+		w.WriteHeader(http.StatusNoContent)
+		return nil, false
+	}
+	if !s.allowQuery(w, userIP.String()) {
+		s.log.Printf("%s: rate limited\n", s.logAddr(ipString))
+		return nil, false
+	}
+	return userIP, true
+}
+
+// Writes the error response for a failed query.
+func (s *httpServer) writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNoMatch) {
+		// Expected until p0f has seen enough traffic from the client, not worth logging
+		http.Error(w, "no match", http.StatusNotFound)
+		return
+	}
+	s.log.Printf("query error: %s\n", err.Error())
+
+	switch {
+	case errors.Is(err, ErrShutdown):
+		// Expected during restarts, the client should retry against the new instance
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service shutting down", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrQueueFull):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "query error", http.StatusInternalServerError)
+	}
+}
+
+// JSON body of a query response.
+// P0fResponse is embedded so its fields are flattened into the same object,
+// followed by the optional fields enabled through HttpOptions.
+type httpResponse struct {
+	P0fResponse
+	DeviceType          string `json:"deviceType,omitempty"`
+	DeviceTypeConfident *bool  `json:"deviceTypeConfident,omitempty"`
+	DistinctOsCount     *int   `json:"distinctOsCount,omitempty"` // Derived, see P0f.DistinctOSCount
+	Placeholder         bool   `json:"placeholder,omitempty"`     // Not from p0f, see WithDevPlaceholder
+	QueriedAt           *int64 `json:"queriedAt,omitempty"`       // See WithQueryMetadata
+	Cached              *bool  `json:"cached,omitempty"`
+}
+
+// Returns the query response for p0fResponse, with the optional fields enabled through HttpOptions.
+func (s *httpServer) newResponse(ip net.IP, p0fResponse P0fResponse, info queryInfo) httpResponse {
+	response := httpResponse{P0fResponse: p0fResponse}
+	if s.cfg.queryMetadata {
+		queriedAt := info.queried.Unix()
+		response.QueriedAt, response.Cached = &queriedAt, &info.cached
+	}
+	if s.cfg.deviceType {
+		deviceType, confident := p0fResponse.DeviceTypeGuess()
+		response.DeviceType, response.DeviceTypeConfident = deviceType, &confident
+	}
+	if s.cfg.distinctOsCount {
+		count := s.p.DistinctOSCount(ip)
+		response.DistinctOsCount = &count
+	}
+	return response
+}
+
+func (s *httpServer) writeResponse(w http.ResponseWriter, r *http.Request, ip net.IP, p0fResponse P0fResponse, info queryInfo) {
+	response := s.newResponse(ip, p0fResponse, info)
+	if s.cfg.fingerprintCookie != nil {
+		cookie := *s.cfg.fingerprintCookie
+		cookie.Value = p0fResponse.Fingerprint()
+		http.SetCookie(w, &cookie)
+	}
+	if response.Stale {
+		// RFC 7234 section 5.5.1, the JSON body also has "stale": true
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	s.writeBody(w, r, s.responseBody(r, response))
+}
+
+// Returns the body of response, with timestamps in the format requested by r.
+func (s *httpServer) responseBody(r *http.Request, response httpResponse) any {
+	// Validated by resolveIP
+	if format, _ := s.timestampFormat(r); format != TimestampSeconds {
+		return newTimestampResponse(response, format)
+	}
+	return response
+}
+
+// Reports whether a failed query for ip should be answered with a placeholder, see WithDevPlaceholder.
+func (s *httpServer) placeholder(ip net.IP) bool {
+	return s.cfg.devPlaceholder && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// Writes the placeholder response for ip. All fingerprint fields are empty.
+func (s *httpServer) writePlaceholder(w http.ResponseWriter, r *http.Request, ip net.IP) {
+	response := httpResponse{
+		P0fResponse: P0fResponse{Ip: ip.String(), LinkClass: LinkUnknown, Flags: []string{}},
+		Placeholder: true,
+	}
+	if s.p.opts.anonymizeIP {
+		response.Ip = AnonymizeIP(ip).String()
+	}
+	s.writeBody(w, r, response)
+}
+
+// Reports whether the p0f queue is at or above the backpressure threshold,
+// and if so the number of seconds clients should wait before retrying.
+func (s *httpServer) saturated() (retryAfter int, saturated bool) {
+	if s.cfg.backpressure <= 0 {
+		return 0, false
+	}
+	stats := s.p.Stats()
+	if float64(stats.QueueLen) < s.cfg.backpressure*float64(stats.QueueCap) {
+		return 0, false
+	}
+	return max(1, int(math.Ceil(s.p.estimatedDrain().Seconds()))), true
+}
+
+// Reports whether the current request should be rejected to shed load.
+//
+// Shedding starts once the p0f queue length reaches the high-water mark
+// and stops once it falls to the low-water mark. While shedding,
+// each request is rejected with the configured probability.
+func (s *httpServer) shed() bool {
+	if s.cfg.shedHigh <= 0 {
+		return false
+	}
+	switch queueLen := s.p.Stats().QueueLen; {
+	case queueLen >= s.cfg.shedHigh:
+		s.shedding.Store(true)
+	case queueLen <= s.cfg.shedLow:
+		s.shedding.Store(false)
+	}
+	return s.shedding.Load() && rand.Float64() < s.cfg.shedFraction
 }
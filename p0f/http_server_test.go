@@ -0,0 +1,1275 @@
+package p0f
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns a server for p resolving every request to 192.0.2.1, with opts applied.
+func newTestServer(p *P0f, opts ...HttpOption) *httpServer {
+	s := newHttpServer(p, func(r *http.Request) string { return "192.0.2.1:1234" }, opts)
+	s.log = log.New(io.Discard, "", 0)
+	return s
+}
+
+func TestNewHandlerMounted(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	mux := http.NewServeMux()
+	mux.Handle("/p0f/", http.StripPrefix("/p0f", NewHandler(p, DefaultIpResolver)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/p0f/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var response P0fResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Ip != "127.0.0.1" || response.OsName == nil {
+		t.Fatalf("response = %+v, want a match for 127.0.0.1", response)
+	}
+}
+
+func TestServeQueryNoMatch(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	w := httptest.NewRecorder()
+	NewHandler(p, DefaultIpResolver).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	handler := NewHandler(p, DefaultIpResolver, WithMetrics())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, want := range []string{
+		`p0f_queries_total{result="ok"} 1`,
+		`p0f_queue_depth 0`,
+		`p0f_query_duration_seconds_bucket{le="+Inf"} 1`,
+		`p0f_query_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestServeQueryFormats(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver)
+
+	for _, test := range []struct {
+		target, accept string
+		status         int
+		contentType    string
+		prefix         string
+	}{
+		{"/", "", http.StatusOK, "application/json", `{"ip":"192.0.2.1"`},
+		{"/", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", http.StatusOK, "application/json", `{`},
+		{"/", "text/csv", http.StatusOK, "text/csv", "ip,firstSeen,"},
+		{"/", "text/*;q=0.5, application/xml", http.StatusOK, "application/xml", "<response><ip>192.0.2.1</ip>"},
+		{"/?format=text", "application/json", http.StatusOK, "text/plain", "ip: 192.0.2.1\n"},
+		{"/?format=yaml", "", http.StatusNotAcceptable, "", ""},
+		{"/", "image/png", http.StatusNotAcceptable, "", ""},
+	} {
+		r := httptest.NewRequest("GET", test.target, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s with Accept %q: status = %d, want %d", test.target, test.accept, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType+";") {
+			t.Errorf("%s with Accept %q: Content-Type = %q, want %s", test.target, test.accept, contentType, test.contentType)
+		}
+		if !strings.HasPrefix(w.Body.String(), test.prefix) {
+			t.Errorf("%s with Accept %q: body = %q, want it to start with %q", test.target, test.accept, w.Body, test.prefix)
+		}
+	}
+}
+
+func TestServeQueryIPFilter(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithIPFilter(nil, PrivateNetworks()))
+
+	for remoteAddr, want := range map[string]int{
+		"192.0.2.1:1234":   http.StatusOK,
+		"127.0.0.1:1234":   http.StatusNoContent,
+		"10.1.2.3:1234":    http.StatusNoContent,
+		"[fe80::1]:1234":   http.StatusNoContent,
+		"[2001:db8::1]:80": http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("query from %s: status = %d, want %d", remoteAddr, w.Code, want)
+		}
+	}
+}
+
+func TestServeHealthChecks(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(p, DefaultIpResolver, WithHealthChecks(), WithServerLogger(log.New(io.Discard, "", 0)))
+	check := func(path string, want int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("%s status = %d, want %d", path, w.Code, want)
+		}
+	}
+
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusOK)
+	p.Shutdown()
+	check("/healthz", http.StatusServiceUnavailable)
+	check("/readyz", http.StatusServiceUnavailable)
+}
+
+func TestServeQueryRateLimit(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithClientRateLimit(0.5, 2, 1), WithServerLogger(log.New(io.Discard, "", 0)))
+	query := func(remoteAddr string, want int) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("query from %s: status = %d, want %d", remoteAddr, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "2" {
+			t.Errorf("Retry-After = %q, want 2", w.Header().Get("Retry-After"))
+		}
+	}
+
+	query("192.0.2.1:1234", http.StatusOK)
+	query("192.0.2.1:1234", http.StatusOK)
+	query("192.0.2.1:1234", http.StatusTooManyRequests)
+	query("192.0.2.2:1234", http.StatusOK)
+	// Only one client is remembered, so the first one was forgotten
+	query("192.0.2.1:1234", http.StatusOK)
+}
+
+func TestServeCORS(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithCORS([]string{"https://example.com"}))
+
+	for _, tt := range []struct {
+		method, origin string
+		wantCode       int
+		wantOrigin     string
+	}{
+		{"GET", "https://example.com", http.StatusOK, "https://example.com"},
+		{"GET", "https://evil.example", http.StatusOK, ""},
+		{"GET", "", http.StatusOK, ""},
+		{"OPTIONS", "https://example.com", http.StatusNoContent, "https://example.com"},
+		{"OPTIONS", "https://evil.example", http.StatusNoContent, ""},
+	} {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s from %q: status = %d, want %d", tt.method, tt.origin, w.Code, tt.wantCode)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%s from %q: Access-Control-Allow-Origin = %q, want %q", tt.method, tt.origin, got, tt.wantOrigin)
+		}
+	}
+}
+
+func TestServePanic(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	resolver := func(r *http.Request) string {
+		panic("resolver panic")
+	}
+	var logged strings.Builder
+	handler := NewHandler(p, resolver, WithServerLogger(log.New(&logged, "", 0)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); strings.Contains(body, "resolver panic") {
+		t.Errorf("body = %q, should not reveal the panic", body)
+	}
+	if !strings.Contains(logged.String(), "resolver panic") {
+		t.Errorf("log = %q, want the panic value", logged.String())
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	for _, tt := range []struct {
+		opts []HttpOption
+		want string
+	}{
+		{nil, ":38749"},
+		{[]HttpOption{WithBindAddress("127.0.0.1")}, "127.0.0.1:38749"},
+		{[]HttpOption{WithBindAddress("::1")}, "[::1]:38749"},
+	} {
+		s := newHttpServer(nil, DefaultIpResolver, tt.opts)
+		if got := s.newServer(DefaultPort).Addr; got != tt.want {
+			t.Errorf("Addr = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	path := filepath.Join(t.TempDir(), "http.sock")
+
+	// A socket left behind by a previous run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	resolver := func(r *http.Request) string { return "192.0.2.1:1234" }
+	s := newHttpServer(p, resolver, []HttpOption{WithUnixListener(path, 0600)})
+	server := s.newServer(DefaultPort)
+	l, err := s.listen(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://p0f/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	// Borrows the test certificate of httptest, valid for example.com
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	path := filepath.Join(t.TempDir(), "https.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resolver := func(r *http.Request) string { return "192.0.2.1:1234" }
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- ServeHttpContext(ctx, p, DefaultPort, resolver, WithTLS(ts.TLS), WithUnixListener(path, 0600),
+			WithServerLogger(log.New(io.Discard, "", 0)))
+	}()
+
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}
+	client := http.Client{Transport: transport}
+	var resp *http.Response
+	for range 100 {
+		if resp, err = client.Get("https://example.com/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("status = %d, TLS = %v, want %d over TLS", resp.StatusCode, resp.TLS != nil, http.StatusOK)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("ServeHttpContext = %v, want nil", err)
+	}
+}
+
+func TestServeAuth(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithAuth(APIKeyAuth("secret", "other")), WithHealthChecks(),
+		WithServerLogger(log.New(io.Discard, "", 0)))
+
+	for _, tt := range []struct {
+		path, header, value string
+		want                int
+	}{
+		{"/", "", "", http.StatusUnauthorized},
+		{"/", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+		{"/", "Authorization", "Bearer secret", http.StatusOK},
+		{"/", "X-API-Key", "other", http.StatusOK},
+		{"/healthz", "", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s with %s %q: status = %d, want %d", tt.path, tt.header, tt.value, w.Code, tt.want)
+		}
+	}
+}
+
+func TestServeGzip(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	for _, tt := range []struct {
+		minSize        int
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{0, "gzip, deflate", true},
+		{0, "gzip;q=0", false},
+		{0, "", false},
+		{1 << 20, "gzip", false},
+	} {
+		handler := NewHandler(p, DefaultIpResolver, WithGzip(tt.minSize))
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+			t.Errorf("minSize %d, Accept-Encoding %q: gzip = %v, want %v", tt.minSize, tt.acceptEncoding, got, tt.wantGzip)
+			continue
+		}
+		if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+		}
+		body := io.Reader(w.Body)
+		if tt.wantGzip {
+			if body, err = gzip.NewReader(w.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var response P0fResponse
+		if err := json.NewDecoder(body).Decode(&response); err != nil || response.OsName == nil {
+			t.Errorf("minSize %d, Accept-Encoding %q: body not a match (%v)", tt.minSize, tt.acceptEncoding, err)
+		}
+	}
+}
+
+func TestServeQueryFields(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/?fields=osName,distance&p=1", nil))
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["osName"]; !ok || len(body) != 2 {
+		t.Errorf("body = %v, want osName and distance only", body)
+	}
+	if !strings.Contains(w.Body.String(), "\n ") {
+		t.Errorf("body = %q, want pretty printed", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/?fields=osName&format=csv", nil))
+	if got := strings.Split(w.Body.String(), "\n")[0]; got != "osName" {
+		t.Errorf("csv header = %q, want osName", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/?fields=osName,bogus", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeQueryTimeRFC3339(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{
+		"192.0.2.1": {FirstSeen: 1700000000, LastSeen: 1700000060},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	for _, tt := range []struct {
+		opts []HttpOption
+		path string
+	}{
+		{nil, "/?time=rfc3339"},
+		{[]HttpOption{WithTimestampFormat(TimestampRFC3339)}, "/"},
+	} {
+		w := httptest.NewRecorder()
+		NewHandler(p, DefaultIpResolver, tt.opts...).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body["firstSeen"] != "2023-11-14T22:13:20Z" || body["lastNat"] != nil {
+			t.Errorf("%s: firstSeen = %v, lastNat = %v, want 2023-11-14T22:13:20Z and null", tt.path, body["firstSeen"], body["lastNat"])
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewHandler(p, DefaultIpResolver).ServeHTTP(w, httptest.NewRequest("GET", "/?time=bogus", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown time format: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeQueryMetadata(t *testing.T) {
+	p, err := New("", WithSynthetic(nil), WithCache(time.Minute, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithQueryMetadata())
+
+	var first int64
+	for i, wantCached := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		var body struct {
+			QueriedAt *int64 `json:"queriedAt"`
+			Cached    *bool  `json:"cached"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.QueriedAt == nil || body.Cached == nil || *body.Cached != wantCached {
+			t.Fatalf("query %d: body = %s, want queriedAt and cached %v", i, w.Body, wantCached)
+		}
+		if i == 0 {
+			first = *body.QueriedAt
+		} else if *body.QueriedAt != first {
+			t.Errorf("cached queriedAt = %d, want %d from the first query", *body.QueriedAt, first)
+		}
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{"192.0.2.1": {OsName: syntheticString("Linux")}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	ts := httptest.NewServer(NewHandler(p, func(r *http.Request) string {
+		return r.URL.Query().Get("ip") + ":1234"
+	}, WithStream(time.Millisecond)))
+	defer ts.Close()
+
+	for ip, want := range map[string]string{
+		"192.0.2.1": `{"osName":"Linux"}`,
+		"192.0.2.2": `{"error":"no match"}`,
+	} {
+		resp, err := http.Get(ts.URL + "/stream?fields=osName&ip=" + ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, ndjsonMediaType) {
+			t.Errorf("Content-Type = %q, want %s", ct, ndjsonMediaType)
+		}
+		lines := bufio.NewScanner(resp.Body)
+		for i := range 3 {
+			if !lines.Scan() {
+				t.Fatalf("%s: stream ended after %d lines: %v", ip, i, lines.Err())
+			}
+			if got := lines.Text(); got != want {
+				t.Errorf("%s: line %d = %s, want %s", ip, i, got, want)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithStatsEndpoint())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats Stats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queries != 1 || stats.Ok != 1 {
+		t.Errorf("stats = %+v, want 1 query with a match", stats)
+	}
+}
+
+func TestLoadSheddingHysteresis(t *testing.T) {
+	var c httpConfig
+	WithLoadShedding(4, 10, 2)(&c)
+	if c.shedLow != 4 || c.shedFraction != 1 {
+		t.Errorf("WithLoadShedding(4, 10, 2) set low %d and fraction %v, want 4 and 1", c.shedLow, c.shedFraction)
+	}
+
+	sockFile, answer := serveOnAnswer(t)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	defer close(answer)
+	s := newTestServer(p, WithLoadShedding(4, 1, 1))
+
+	var queries uint64
+	query := func(n int) {
+		t.Helper()
+		for range n {
+			go p.Query(net.ParseIP("192.0.2.1"))
+		}
+		queries += uint64(n)
+		for deadline := time.Now().Add(time.Second); p.Stats().Queries != queries; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d queries enqueued, want %d", p.Stats().Queries, queries)
+			}
+		}
+	}
+	// Answers queries until n are left waiting in the queue
+	drain := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); p.Stats().QueueLen != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("queue length %d, want %d", p.Stats().QueueLen, n)
+			}
+			if p.Stats().QueueLen < n {
+				continue
+			}
+			select {
+			case answer <- struct{}{}:
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	// Queries are left in the queue once the pipeline is full, drain answers the others
+	for _, step := range []struct {
+		add, queueLen int
+		want          bool
+	}{
+		{2, 0, false},
+		{3, 3, false},
+		{1, 4, true}, // High-water mark reached
+		{0, 2, true}, // Still shedding above the low-water mark
+		{0, 1, false},
+		{2, 3, false}, // Not shedding again until the high-water mark
+	} {
+		query(step.add)
+		drain(step.queueLen)
+		if got := s.shed(); got != step.want {
+			t.Fatalf("shed() with queue length %d = %v, want %v", step.queueLen, got, step.want)
+		}
+	}
+
+	query(1)
+	drain(4)
+	w := httptest.NewRecorder()
+	s.serveQuery(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("status = %d with Retry-After %q while shedding, want %d with Retry-After", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+}
+
+func TestServePoll(t *testing.T) {
+	// No match until matched is set, as for a client p0f has not seen enough packets of yet
+	var matched atomic.Bool
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(net.IP) []byte {
+		if matched.Load() {
+			return matchResponse(1234, 0)
+		}
+		return noMatchResponse()
+	})
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	poll := func(timeout time.Duration) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		newTestServer(p, WithLongPoll(timeout)).servePoll(w, httptest.NewRequest("GET", "/poll", nil))
+		return w
+	}
+	started := time.Now()
+	if w := poll(100 * time.Millisecond); w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("status = %d with body %q at the timeout, want %d", w.Code, w.Body.String(), http.StatusNoContent)
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Errorf("poll returned after %v, before its timeout", elapsed)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { matched.Store(true) })
+	w := poll(5 * time.Second)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d after a match during the poll, want %d", w.Code, http.StatusOK)
+	}
+	var response P0fResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Ip != "192.0.2.1" || response.FirstSeen != 1234 {
+		t.Errorf("response = %+v, want the match for 192.0.2.1", response)
+	}
+}
+
+func TestServeQueryShutdown(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Shutdown()
+
+	w := httptest.NewRecorder()
+	newTestServer(p).serveQuery(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("status = %d with Retry-After %q after Shutdown, want %d with Retry-After 1", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	match := rawResponse{Magic: magicBytesRcv, Status: resultOk}
+	copy(match.OsName[:], "Linux")
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(ip net.IP) []byte {
+		if ip.String() == "192.0.2.1" {
+			return encodeRaw(t, match)
+		}
+		return noMatchResponse()
+	})
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	s := newTestServer(p, WithBatch(2))
+	batch := func(body, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.serveBatch(w, r)
+		return w
+	}
+
+	w := batch(`["192.0.2.1","192.0.2.2"]`, "")
+	var results []batchResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Response == nil || *results[0].Response.OsName != "Linux" ||
+		results[1].Error == nil || *results[1].Error != "no match" {
+		t.Fatalf("results = %+v, want a match then no match", results)
+	}
+
+	if vary := w.Header().Get("Vary"); vary != "Accept" {
+		t.Errorf("Vary = %q, want Accept", vary)
+	}
+	for _, tt := range []struct {
+		accept string
+		want   int
+	}{
+		{"application/json", http.StatusOK},
+		{"text/csv;q=0.9, application/*;q=0.5", http.StatusOK},
+		{"*/*", http.StatusOK},
+		{"text/csv", http.StatusNotAcceptable},
+		{"application/json;q=0", http.StatusNotAcceptable},
+	} {
+		if w := batch(`["192.0.2.1"]`, tt.accept); w.Code != tt.want {
+			t.Errorf("batch accepting %q: status = %d, want %d", tt.accept, w.Code, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`["192.0.2.1","not an ip"]`, http.StatusBadRequest},
+		{`{"ip":"192.0.2.1"}`, http.StatusBadRequest},
+		{`["192.0.2.1","192.0.2.2","192.0.2.3"]`, http.StatusRequestEntityTooLarge},
+	} {
+		if w := batch(tt.body, ""); w.Code != tt.want {
+			t.Errorf("batch of %.20s... status = %d, want %d", tt.body, w.Code, tt.want)
+		}
+	}
+}
+
+func TestServeBatchRateLimit(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	handler := NewHandler(p, DefaultIpResolver, WithBatch(100), WithRateLimit(0.5, 3), WithClientRateLimit(0.5, 2, 10),
+		WithServerLogger(log.New(io.Discard, "", 0)))
+	batch := func(remoteAddr, body string, want int) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("batch %s from %s: status = %d, want %d", body, remoteAddr, w.Code, want)
+		}
+	}
+
+	batch("192.0.2.1:1234", `["192.0.2.10","192.0.2.11","192.0.2.12"]`, http.StatusRequestEntityTooLarge)
+	batch("192.0.2.1:1234", `["192.0.2.10","192.0.2.11"]`, http.StatusOK)
+	batch("192.0.2.1:1234", `["192.0.2.10"]`, http.StatusTooManyRequests)
+	// The global bucket has a token left, not two, so the batch is refused
+	// without spending the tokens of the client
+	batch("192.0.2.2:1234", `["192.0.2.10","192.0.2.11"]`, http.StatusTooManyRequests)
+	batch("192.0.2.2:1234", `["192.0.2.10"]`, http.StatusOK)
+
+	s := newHttpServer(p, DefaultIpResolver, []HttpOption{WithRateLimit(0.5, 1), WithClientRateLimit(0.5, 2, 10)})
+	s.rateLimit.take()
+	if s.allowQuery(httptest.NewRecorder(), "192.0.2.3") {
+		t.Fatal("query allowed with the global bucket empty")
+	}
+	if ok, _ := s.clientLimits.bucket("192.0.2.3").takeN(2); !ok {
+		t.Error("the query refused by the global limit took a token from the client")
+	}
+}
+
+func TestServeQueryMinMatchQuality(t *testing.T) {
+	matchQ := map[string]byte{"192.0.2.1": 0, "192.0.2.2": matchFuzzy, "192.0.2.3": matchGeneric}
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(ip net.IP) []byte {
+		r := rawResponse{Magic: magicBytesRcv, Status: resultOk, OsMatchQ: matchQ[ip.String()]}
+		copy(r.OsName[:], "Linux")
+		return encodeRaw(t, r)
+	})
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	s := newTestServer(p, WithMinMatchQuality(MatchGeneric))
+	s.ipResolver = func(r *http.Request) string { return r.RemoteAddr }
+	for ip, want := range map[string]int{
+		"192.0.2.1": http.StatusOK,
+		"192.0.2.2": http.StatusNotFound,
+		"192.0.2.3": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		s.serveQuery(w, r)
+		if w.Code != want {
+			t.Errorf("status for %s = %d, want %d", ip, w.Code, want)
+		}
+	}
+}
+
+func TestServeQueryStaleWarning(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	stop := serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile, WithCache(10*time.Millisecond, 10), WithStaleOnError(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	s := newTestServer(p)
+
+	w := httptest.NewRecorder()
+	s.serveQuery(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Fatalf("status = %d with Warning %q, want %d without one", w.Code, w.Header().Get("Warning"), http.StatusOK)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	w = httptest.NewRecorder()
+	s.serveQuery(w, httptest.NewRequest("GET", "/", nil))
+	if want := `110 - "Response is Stale"`; w.Code != http.StatusOK || w.Header().Get("Warning") != want {
+		t.Fatalf("status = %d with Warning %q while p0f is unavailable, want %d with %s", w.Code, w.Header().Get("Warning"), http.StatusOK, want)
+	}
+	var response P0fResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Stale {
+		t.Errorf("response = %s, want stale set", w.Body.String())
+	}
+}
+
+func TestServeQueryTimeFormats(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1700000000)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	for _, tt := range []struct {
+		opts      []HttpOption
+		path      string
+		firstSeen any
+		lastNat   any
+	}{
+		{nil, "/", json.Number("1700000000"), json.Number("0")},
+		{nil, "/?time=unix", json.Number("1700000000"), json.Number("0")},
+		{nil, "/?time=millis", json.Number("1700000000000"), json.Number("0")},
+		{[]HttpOption{WithTimestampFormat(TimestampMillis)}, "/", json.Number("1700000000000"), json.Number("0")},
+		{nil, "/?time=string", "1700000000", "0"},
+		{[]HttpOption{WithTimestampFormat(TimestampString)}, "/", "1700000000", "0"},
+		{[]HttpOption{WithTimestampFormat(TimestampString)}, "/?time=unix", json.Number("1700000000"), json.Number("0")},
+	} {
+		w := httptest.NewRecorder()
+		newTestServer(p, tt.opts...).serveQuery(w, httptest.NewRequest("GET", tt.path, nil))
+		dec := json.NewDecoder(w.Body)
+		dec.UseNumber()
+		var body map[string]any
+		if err := dec.Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body["firstSeen"] != tt.firstSeen || body["lastNat"] != tt.lastNat {
+			t.Errorf("%s with %d options: firstSeen = %#v, lastNat = %#v, want %#v and %#v", tt.path, len(tt.opts), body["firstSeen"], body["lastNat"], tt.firstSeen, tt.lastNat)
+		}
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	if got := newTestServer(nil).newServer(DefaultPort).MaxHeaderBytes; got != defaultMaxHeaderBytes {
+		t.Errorf("MaxHeaderBytes = %d, want %d", got, defaultMaxHeaderBytes)
+	}
+
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	server := newTestServer(p, WithMaxHeaderBytes(1<<10)).newServer(0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	// net/http allows 4 KiB more than MaxHeaderBytes for its read buffer
+	for size, want := range map[int]int{
+		100:      http.StatusOK,
+		16 << 10: http.StatusRequestHeaderFieldsTooLarge,
+	} {
+		r, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Padding", strings.Repeat("a", size))
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("status with a %d bytes header = %d, want %d", size, res.StatusCode, want)
+		}
+	}
+}
+
+func TestServeQueryBackpressure(t *testing.T) {
+	sockFile, answer := serveOnAnswer(t)
+	p, err := New(sockFile, WithQueueSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	defer close(answer)
+	s := newTestServer(p, WithBackpressure(0.5))
+	// Makes n more queries, all but the one written to p0f wait in the queue
+	queries := 0
+	query := func(n int) {
+		t.Helper()
+		for range n {
+			go p.Query(net.ParseIP("192.0.2.2"))
+		}
+		queries += n
+		want := max(0, queries-1)
+		for deadline := time.Now().Add(time.Second); p.Stats().QueueLen != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("queue length %d, want %d", p.Stats().QueueLen, want)
+			}
+		}
+	}
+
+	query(2)
+	if _, saturated := s.saturated(); saturated {
+		t.Fatalf("saturated with queue length %d, below the threshold", p.Stats().QueueLen)
+	}
+	query(1)
+
+	// Without a round trip time yet, the estimate is the minimum
+	w := httptest.NewRecorder()
+	s.serveQuery(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("status = %d with Retry-After %q at the threshold, want %d with Retry-After 1", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	// 2 queued requests answered one at a time, 1.5s each
+	p.stats.observeRoundTrip(1500 * time.Millisecond)
+	if got := p.estimatedDrain(); got != 3*time.Second {
+		t.Errorf("estimatedDrain() = %v, want 3s", got)
+	}
+	w = httptest.NewRecorder()
+	s.serveQuery(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("status = %d with Retry-After %q, want %d with Retry-After 3", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	endpoints := []string{"/", "/poll", "/stream", "/batch", "/openapi.json", "/metrics", "/stats", "/healthz", "/readyz"}
+	for _, opts := range [][]HttpOption{
+		{WithOpenAPI()},
+		{WithOpenAPI(), WithLongPoll(time.Second), WithStream(time.Second), WithBatch(10), WithMetrics(), WithStatsEndpoint(), WithHealthChecks()},
+	} {
+		s := newTestServer(p, opts...)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		var spec struct {
+			OpenAPI string
+			Paths   map[string]map[string]any
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+			t.Fatalf("/openapi.json is not valid JSON: %v", err)
+		}
+		if !strings.HasPrefix(spec.OpenAPI, "3.") {
+			t.Errorf("openapi = %q, want 3.x", spec.OpenAPI)
+		}
+		// Every route of the mux is described, and nothing else
+		for _, path := range endpoints {
+			_, pattern := s.mux.Handler(httptest.NewRequest("GET", path, nil))
+			if _, described := spec.Paths[path]; described != (pattern == path) {
+				t.Errorf("%d options: %s described %v, routed to %q", len(opts), path, described, pattern)
+			}
+		}
+		if len(spec.Paths) > len(endpoints) {
+			t.Errorf("%d options: %d paths described, more than the %d endpoints", len(opts), len(spec.Paths), len(endpoints))
+		}
+	}
+}
+
+func TestServeFingerprintCookie(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{"192.0.2.1": {OsName: syntheticString("Linux"), Distance: 12}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	s := newTestServer(p, WithFingerprintCookie(http.Cookie{
+		Name: "p0f", Path: "/", MaxAge: 3600, HttpOnly: true, Secure: true, SameSite: http.SameSiteStrictMode,
+	}))
+	s.ipResolver = DefaultIpResolver
+	serve := func(remoteAddr string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		s.serveQuery(w, r)
+		return w.Result()
+	}
+
+	res := serve("192.0.2.1:1234")
+	cookies := res.Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("%d cookies set, want 1", len(cookies))
+	}
+	want := P0fResponse{OsName: syntheticString("Linux"), Distance: 12}.Fingerprint()
+	if c := cookies[0]; c.Name != "p0f" || c.Value != want || c.Path != "/" || c.MaxAge != 3600 || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie = %+v, want p0f=%s with the attributes of the template", c, want)
+	}
+	if cookies := serve("192.0.2.2:1234").Cookies(); len(cookies) != 0 {
+		t.Errorf("cookies %v set for a response without a match", cookies)
+	}
+
+	s = newTestServer(p, WithFingerprintCookie(http.Cookie{}))
+	s.ipResolver = DefaultIpResolver
+	if cookies := serve("192.0.2.1:1234").Cookies(); len(cookies) != 0 {
+		t.Errorf("cookies %v set with a cookie template without a name", cookies)
+	}
+}
+
+func TestServeDevPlaceholder(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{"10.0.0.2": {OsName: syntheticString("Linux")}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	for _, tt := range []struct {
+		opts            []HttpOption
+		remoteAddr      string
+		wantCode        int
+		wantPlaceholder bool
+	}{
+		{[]HttpOption{WithDevPlaceholder()}, "127.0.0.1:1234", http.StatusOK, true},
+		{[]HttpOption{WithDevPlaceholder()}, "10.0.0.1:1234", http.StatusOK, true},
+		{[]HttpOption{WithDevPlaceholder()}, "[fe80::1]:1234", http.StatusOK, true},
+		{[]HttpOption{WithDevPlaceholder()}, "10.0.0.2:1234", http.StatusOK, false}, // p0f has a match
+		{[]HttpOption{WithDevPlaceholder()}, "192.0.2.1:1234", http.StatusNotFound, false},
+		{nil, "127.0.0.1:1234", http.StatusNotFound, false},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		s := newTestServer(p, tt.opts...)
+		s.ipResolver = DefaultIpResolver
+		s.serveQuery(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s with %d options: status = %d, want %d", tt.remoteAddr, len(tt.opts), w.Code, tt.wantCode)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Placeholder bool
+			OsName      *string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Placeholder != tt.wantPlaceholder || (body.Placeholder && body.OsName != nil) {
+			t.Errorf("%s: response = %s, want placeholder %v", tt.remoteAddr, w.Body.String(), tt.wantPlaceholder)
+		}
+	}
+}
+
+// Returns a TCP port that was free a moment ago, for tests starting a server on a port.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeHttpContextGracefulShutdown(t *testing.T) {
+	sockFile, answer := serveOnAnswer(t)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	defer close(answer)
+
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	resolver := func(r *http.Request) string { return "192.0.2.1:1234" }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeHttpContext(ctx, p, port, resolver)
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not listening")
+		}
+	}
+
+	// A query waiting for p0f when the context is cancelled
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Error(err)
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	for deadline := time.Now().Add(time.Second); p.Stats().Queries != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("query not sent to p0f")
+		}
+	}
+	cancel()
+
+	// New connections are refused, while the server waits for the query in flight
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepting connections after the context was cancelled")
+		}
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("ServeHttpContext returned %v before the query in flight was answered", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	answer <- struct{}{}
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("status of the query in flight = %d, want %d", got, http.StatusOK)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeHttpContext error = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeHttpContext did not return after the query in flight was answered")
+	}
+}
+
+func TestServeHttpContextListenError(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	goroutines := runtime.NumGoroutine()
+	for range 20 {
+		if err := ServeHttpContext(context.Background(), p, port, DefaultIpResolver); err == nil {
+			t.Fatal("ServeHttpContext listening on a port in use succeeded")
+		}
+	}
+	if leaked := runtime.NumGoroutine() - goroutines; leaked >= 20 {
+		t.Errorf("%d goroutines left after ServeHttpContext failed 20 times", leaked)
+	}
+}
@@ -0,0 +1,71 @@
+package p0f
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Media type of the stream endpoint, one JSON object per line
+const ndjsonMediaType = "application/x-ndjson"
+
+// Line of the stream endpoint for a failed query.
+type streamError struct {
+	Error string `json:"error"`
+}
+
+// Handles a streaming query for the client IP (example: http://localhost:38749/stream).
+// The client IP is queried every configured interval, writing one JSON line for each result
+// until the client disconnects: the query response, or {"error": "no match"} while p0f
+// has no match (or one below the minimum match quality). The stream ends once p0f is shut down.
+//
+// The query parameters of the query endpoint apply, except format, the stream is always NDJSON.
+func (s *httpServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	userIP, ok := s.resolveIP(w, r, false)
+	if !ok {
+		return
+	}
+	names, _ := s.selectedFields(r.URL.Query().Get("fields")) // Validated by resolveIP
+
+	w.Header().Set("Content-Type", ndjsonMediaType+"; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	ticker := time.NewTicker(s.cfg.streamInterval)
+	defer ticker.Stop()
+	for {
+		var line any
+		response, info, err := s.query(r, userIP)
+		switch {
+		case err == nil && response.MatchQuality() >= s.cfg.minMatchQuality:
+			line = s.responseBody(r, s.newResponse(userIP, response, info))
+			if names != nil {
+				if line, err = selectFields(line, names); err != nil {
+					s.log.Printf("stream encode error: %s\n", err.Error())
+					return
+				}
+			}
+		case err == nil || errors.Is(err, ErrNoMatch):
+			line = streamError{"no match"}
+		case errors.Is(err, ErrShutdown), r.Context().Err() != nil:
+			return
+		default:
+			s.log.Printf("stream query error: %s\n", err.Error())
+			line = streamError{"query error"}
+		}
+		if err := enc.Encode(line); err != nil {
+			return // Disconnected
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
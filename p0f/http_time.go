@@ -0,0 +1,87 @@
+package p0f
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimestampFormat selects how the unix time fields of a response
+// (firstSeen, lastSeen, lastNat and lastChg) are encoded in JSON.
+type TimestampFormat int
+
+const (
+	TimestampSeconds TimestampFormat = iota // Unix seconds as a number (default)
+	TimestampMillis                         // Unix milliseconds as a number
+	TimestampString                         // Unix seconds as a string, for clients that mishandle large numbers
+	TimestampRFC3339                        // RFC 3339 string in UTC, null for zero (never)
+)
+
+// Names of the formats for the time query parameter (example: http://localhost:38749/?time=rfc3339).
+var timestampFormatNames = []string{
+	TimestampSeconds: "unix",
+	TimestampMillis:  "millis",
+	TimestampString:  "string",
+	TimestampRFC3339: "rfc3339",
+}
+
+// Returns the format of the time query parameter with the given name.
+func parseTimestampFormat(name string) (TimestampFormat, error) {
+	for format, n := range timestampFormatNames {
+		if n == name {
+			return TimestampFormat(format), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown time format %q", name)
+}
+
+// Response body used with a TimestampFormat other than TimestampSeconds.
+// The fields declared here shadow the numeric fields of the embedded P0fResponse.
+type timestampResponse struct {
+	httpResponse
+	FirstSeen any `json:"firstSeen"`
+	LastSeen  any `json:"lastSeen"`
+	LastNat   any `json:"lastNat"`
+	LastChg   any `json:"lastChg"`
+	QueriedAt any `json:"queriedAt,omitempty"`
+}
+
+func newTimestampResponse(r httpResponse, format TimestampFormat) timestampResponse {
+	response := timestampResponse{
+		httpResponse: r,
+		FirstSeen:    formatTimestamp(r.FirstSeen, format),
+		LastSeen:     formatTimestamp(r.LastSeen, format),
+		LastNat:      formatTimestamp(r.LastNat, format),
+		LastChg:      formatTimestamp(r.LastChg, format),
+	}
+	if r.QueriedAt != nil {
+		response.QueriedAt = formatTimestamp(uint32(*r.QueriedAt), format)
+	}
+	return response
+}
+
+func formatTimestamp(unix uint32, format TimestampFormat) any {
+	switch format {
+	case TimestampMillis:
+		return uint64(unix) * 1000
+	case TimestampString:
+		return strconv.FormatUint(uint64(unix), 10)
+	case TimestampRFC3339:
+		if unix == 0 {
+			return nil
+		}
+		return time.Unix(int64(unix), 0).UTC().Format(time.RFC3339)
+	default:
+		return unix
+	}
+}
+
+// Returns the timestamp format for r, from the time query parameter if present,
+// otherwise the one set by WithTimestampFormat.
+func (s *httpServer) timestampFormat(r *http.Request) (TimestampFormat, error) {
+	if name := r.URL.Query().Get("time"); name != "" {
+		return parseTimestampFormat(name)
+	}
+	return s.cfg.timestampFormat, nil
+}
@@ -0,0 +1,46 @@
+package p0f
+
+import "net"
+
+var (
+	anonymizeMask4 = net.CIDRMask(24, 32)  // zeroes the last octet
+	anonymizeMask6 = net.CIDRMask(48, 128) // zeroes the last 80 bits
+)
+
+// Returns ip with its host part zeroed: the last octet of an IPv4 address,
+// or the last 80 bits of an IPv6 address. IPv4 addresses are returned in 4-byte form.
+// Invalid addresses are returned unchanged.
+func AnonymizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(anonymizeMask4)
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return ip6.Mask(anonymizeMask6)
+	}
+	return ip
+}
+
+// Returns the networks of addresses that are not publicly routable: loopback, link-local,
+// private (RFC 1918 and IPv6 unique local), carrier-grade NAT and unspecified addresses.
+// Use it as the deny list of WithIPFilter to fingerprint external clients only.
+func PrivateNetworks() []net.IPNet {
+	var networks []net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		networks = append(networks, *n)
+	}
+	return networks
+}
+
+// Reports whether ip is in any of networks.
+func inNetworks(ip net.IP, networks []net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
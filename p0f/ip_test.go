@@ -0,0 +1,49 @@
+package p0f
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.123", "192.0.2.0"},
+		{"192.0.2.0", "192.0.2.0"},
+		{"::ffff:198.51.100.7", "198.51.100.0"},
+		{"2001:db8:1234:5678:9abc::1", "2001:db8:1234::"},
+		{"2001:db8:1234:ffff:ffff:ffff:ffff:ffff", "2001:db8:1234::"},
+		{"::1", "::"},
+	} {
+		got := AnonymizeIP(net.ParseIP(tt.ip))
+		if got.String() != tt.want {
+			t.Errorf("AnonymizeIP(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+		if got.To4() != nil && len(got) != net.IPv4len {
+			t.Errorf("AnonymizeIP(%s) is %d bytes long, want the 4-byte form", tt.ip, len(got))
+		}
+	}
+	if got := AnonymizeIP(net.IP{1, 2, 3}); !got.Equal(net.IP{1, 2, 3}) {
+		t.Errorf("AnonymizeIP of an invalid address = %v, want it unchanged", got)
+	}
+}
+
+func TestQueryAnonymizeIP(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile, WithAnonymizeIP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	r, err := p.Query(net.ParseIP("192.0.2.123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ip != "192.0.2.0" {
+		t.Errorf("Ip = %q, want 192.0.2.0", r.Ip)
+	}
+}
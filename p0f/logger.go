@@ -0,0 +1,28 @@
+package p0f
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Logger receives the messages logged by this package, see WithLogger and WithServerLogger.
+// *log.Logger implements it, use SlogLogger to log to a *slog.Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Returns a Logger writing each message to l at level.
+func SlogLogger(l *slog.Logger, level slog.Level) Logger {
+	return slogLogger{l, level}
+}
+
+type slogLogger struct {
+	l     *slog.Logger
+	level slog.Level
+}
+
+func (s slogLogger) Printf(format string, v ...any) {
+	s.l.Log(context.Background(), s.level, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
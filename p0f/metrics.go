@@ -0,0 +1,99 @@
+package p0f
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the query duration histogram buckets, in seconds.
+// Queries answered by a local p0f take well under a millisecond, queued ones may take seconds.
+var durationBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram of durations over durationBuckets. All fields are updated atomically.
+type histogram struct {
+	counts [16]atomic.Uint64 // Per bucket, not cumulative. The last one counts durations above every bound.
+	sum    atomic.Int64      // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(durationBuckets) && d.Seconds() > durationBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Buckets: make([]HistogramBucket, len(h.counts)), Sum: time.Duration(h.sum.Load())}
+	for i := range h.counts {
+		bound := time.Duration(math.MaxInt64)
+		if i < len(durationBuckets) {
+			bound = time.Duration(durationBuckets[i] * float64(time.Second))
+		}
+		s.Buckets[i] = HistogramBucket{UpperBound: bound, Count: h.counts[i].Load()}
+		s.Count += s.Buckets[i].Count
+	}
+	return s
+}
+
+// Writes the counters of p in the Prometheus text exposition format:
+//
+//   - p0f_queries_total, the completed queries by result ("ok", "nomatch", "badquery" or "error")
+//   - p0f_queue_full_total, the queries rejected because the request queue was full
+//   - p0f_reconnects_total, the successful reconnects to the p0f socket
+//   - p0f_queue_depth and p0f_queue_capacity, the requests waiting in the queue and its capacity
+//   - p0f_query_duration_seconds, a histogram of the time from queueing a query to its completion
+//   - p0f_roundtrip_duration_seconds, a histogram of the time from sending a query to p0f to its completion
+//
+// Cache hits are answered without a query, and are not counted.
+func (p *P0f) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	s := p.Stats()
+
+	fmt.Fprintln(bw, "# HELP p0f_queries_total Queries completed by p0f, by result.")
+	fmt.Fprintln(bw, "# TYPE p0f_queries_total counter")
+	for _, c := range []struct {
+		result string
+		value  uint64
+	}{{"ok", s.Ok}, {"nomatch", s.NoMatch}, {"badquery", s.BadQuery}, {"error", s.Errors}} {
+		fmt.Fprintf(bw, "p0f_queries_total{result=%q} %d\n", c.result, c.value)
+	}
+	writeMetric(bw, "p0f_queue_full_total", "counter", "Queries rejected because the request queue was full.", s.QueueFull)
+	writeMetric(bw, "p0f_reconnects_total", "counter", "Successful reconnects to the p0f socket.", s.Reconnects)
+	writeMetric(bw, "p0f_queue_depth", "gauge", "Requests waiting in the queue.", s.QueueLen)
+	writeMetric(bw, "p0f_queue_capacity", "gauge", "Capacity of the request queue.", s.QueueCap)
+
+	writeHistogram(bw, "p0f_query_duration_seconds", "Time from queueing a query to its completion.", p.stats.duration.snapshot())
+	writeHistogram(bw, "p0f_roundtrip_duration_seconds", "Time from sending a query to p0f to its completion.", s.RoundTrips)
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name, help string, h Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var count uint64
+	for i, bound := range durationBuckets {
+		count += h.Buckets[i].Count
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+func writeMetric[T uint64 | int](w io.Writer, name, kind, help string, value T) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+func (s *httpServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.p.WriteMetrics(w); err != nil {
+		s.log.Printf("error writing metrics: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,404 @@
+package p0f
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Option configures a P0f instance, see New.
+type Option func(*options) error
+
+type options struct {
+	cacheTTL             time.Duration
+	cacheMaxEntries      int
+	staleTTL             time.Duration
+	negativeCache        bool
+	negativeTTL          time.Duration
+	coalesceWindow       time.Duration
+	singleFlight         bool
+	idleReconnect        time.Duration
+	sanitizer            func(string) string
+	pipelineDepth        int
+	anonymizeIP          bool
+	retryRate            float64
+	retryBurst           int
+	osHistoryMaxIPs      int
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	reconnectMin         time.Duration
+	reconnectMax         time.Duration
+	reconnectMaxAttempts int
+	reconnectMaxElapsed  time.Duration
+	reconnectHook        func(attempt int, err error)
+	reconnectedHook      func()
+	queueSize            int
+	enqueueTimeout       time.Duration
+	logger               Logger
+	dialTimeout          time.Duration
+	connections          int
+	byteOrder            binary.ByteOrder
+	tracer               Tracer
+	dial                 func() (net.Conn, error) // Replaces dialing the unix socket, see WithDialer and WithSynthetic
+}
+
+// Caches successful responses for ttl, keeping at most maxEntries IP addresses.
+// When the cache is full, the least recently used entry is evicted.
+// Expired entries are evicted when next looked up.
+//
+// Entries are keyed by the normalized IP string, so the IPv4 and IPv4-mapped IPv6
+// forms of an address share an entry. Use QueryFresh to bypass the cache for a query.
+// No match results are not cached unless WithNegativeCache is used.
+func WithCache(ttl time.Duration, maxEntries int) Option {
+	return func(o *options) error {
+		if ttl <= 0 {
+			return errors.New("cache ttl must be positive")
+		}
+		if maxEntries <= 0 {
+			return errors.New("cache maxEntries must be positive")
+		}
+		o.cacheTTL, o.cacheMaxEntries = ttl, maxEntries
+		return nil
+	}
+}
+
+// Serves expired cache entries when p0f cannot be queried,
+// for example because the socket is disconnected or the request queue is full.
+// Entries are retained for up to maxAge past their TTL for this purpose,
+// and responses served this way have Stale set.
+//
+// No match and bad query results are never replaced by stale data.
+// Requires WithCache.
+func WithStaleOnError(maxAge time.Duration) Option {
+	return func(o *options) error {
+		if maxAge <= 0 {
+			return errors.New("stale maxAge must be positive")
+		}
+		o.staleTTL = maxAge
+		return nil
+	}
+}
+
+// Caches no match results for ttl, so clients p0f has not identified yet are not queried
+// again for every request. Keep ttl short, p0f can have a match as soon as it sees
+// a few more packets. A ttl of 0 uses a tenth of the WithCache ttl.
+//
+// Cached no match results are returned as ErrNoMatch, so the long-poll endpoint of the
+// HTTP server only sees a new match once they expire. QueryFresh bypasses them as any other entry.
+// Requires WithCache.
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(o *options) error {
+		if ttl < 0 {
+			return errors.New("negative cache ttl must not be negative")
+		}
+		o.negativeCache, o.negativeTTL = true, ttl
+		return nil
+	}
+}
+
+// Serves all queries for the same IP that arrive within window of each other
+// from a single p0f query. Browsers commonly open several parallel connections,
+// this avoids querying p0f once for each of them.
+//
+// Coalescing happens after the cache lookup and before querying p0f.
+func WithCoalesceWindow(window time.Duration) Option {
+	return func(o *options) error {
+		if window <= 0 {
+			return errors.New("coalesce window must be positive")
+		}
+		o.coalesceWindow = window
+		return nil
+	}
+}
+
+// Serves concurrent queries for the same IP from a single p0f query,
+// fanning its result out to every caller waiting on it. Unlike WithCoalesceWindow,
+// a query started after the shared one completed is sent to p0f again.
+// Use QueryFresh for queries that must not share a result.
+func WithSingleFlight() Option {
+	return func(o *options) error {
+		o.singleFlight = true
+		return nil
+	}
+}
+
+// Reconnects to p0f before sending a query if the connection has not been used for idle.
+// p0f's first-line behavior then applies again, instead of answering
+// over a connection whose state may have expired on the p0f side.
+func WithIdleReconnect(idle time.Duration) Option {
+	return func(o *options) error {
+		if idle <= 0 {
+			return errors.New("idle reconnect duration must be positive")
+		}
+		o.idleReconnect = idle
+		return nil
+	}
+}
+
+// Applies sanitize to every string field of a response (OsName, OsFlavor, HttpName,
+// HttpFlavor, LinkType and Language) before it is returned or cached.
+// Use this to enforce escaping or filtering required where the fields are rendered.
+// A field sanitized to the empty string becomes nil.
+func WithSanitizer(sanitize func(string) string) Option {
+	return func(o *options) error {
+		if sanitize == nil {
+			return errors.New("sanitizer must not be nil")
+		}
+		o.sanitizer = sanitize
+		return nil
+	}
+}
+
+// Allows up to depth requests to be sent to p0f before their responses have been read.
+// p0f answers requests on a connection in order, so this overlaps the socket
+// round trips of consecutive queries. The default of 1 waits for each response
+// before sending the next request.
+func WithPipelineDepth(depth int) Option {
+	return func(o *options) error {
+		if depth <= 0 {
+			return errors.New("pipeline depth must be positive")
+		}
+		o.pipelineDepth = depth
+		return nil
+	}
+}
+
+// Anonymizes the Ip field of responses with AnonymizeIP, and the client addresses
+// logged by the HTTP server. p0f is still queried with the full address.
+func WithAnonymizeIP() Option {
+	return func(o *options) error {
+		o.anonymizeIP = true
+		return nil
+	}
+}
+
+// Limits the retries made by p to a token bucket of burst tokens, refilled at rate tokens per second.
+// Every retry takes a token and is skipped when none are left, so retries stay
+// bounded under sustained failure instead of multiplying the load. See Stats.Retries
+// and Stats.RetriesDenied. Retries are unlimited by default.
+//
+// Temporary socket errors are retried, as are no matches at the long-poll endpoint
+// and failed reconnects.
+func WithRetryBudget(rate float64, burst int) Option {
+	return func(o *options) error {
+		if rate <= 0 {
+			return errors.New("retry budget rate must be positive")
+		}
+		if burst <= 0 {
+			return errors.New("retry budget burst must be positive")
+		}
+		o.retryRate, o.retryBurst = rate, burst
+		return nil
+	}
+}
+
+// Keeps track of the distinct OS names p0f reports for up to maxIPs addresses,
+// see DistinctOSCount. When full, the least recently updated address is forgotten.
+func WithOSHistory(maxIPs int) Option {
+	return func(o *options) error {
+		if maxIPs <= 0 {
+			return errors.New("OS history maxIPs must be positive")
+		}
+		o.osHistoryMaxIPs = maxIPs
+		return nil
+	}
+}
+
+// Fails a query with ErrTimeout if p0f does not answer it within timeout after it was sent.
+// 0 waits forever. The default is 5 seconds.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return errors.New("read timeout must not be negative")
+		}
+		o.readTimeout = timeout
+		return nil
+	}
+}
+
+// Fails a query with ErrTimeout if it cannot be written to the p0f socket within timeout.
+// 0 waits forever. The default is 5 seconds.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return errors.New("write timeout must not be negative")
+		}
+		o.writeTimeout = timeout
+		return nil
+	}
+}
+
+// Re-dials the p0f socket when reading or writing it fails, for example because p0f was restarted.
+// Failed attempts are retried after initial, doubling the delay each time up to max,
+// until one succeeds, p is shut down or WithReconnectLimit is reached. Each delay is randomized
+// to between half of it and all of it. Retries draw from the retry budget, see WithRetryBudget.
+//
+// Queries in flight when the connection is lost fail with an error wrapping ErrDisconnected.
+// Without this option, queries keep failing until Reconnect is called.
+func WithReconnect(initial, max time.Duration) Option {
+	return func(o *options) error {
+		if initial <= 0 {
+			return errors.New("reconnect initial delay must be positive")
+		}
+		if max < initial {
+			return errors.New("reconnect max delay must not be less than the initial delay")
+		}
+		o.reconnectMin, o.reconnectMax = initial, max
+		return nil
+	}
+}
+
+// Stops reconnecting after maxAttempts failed attempts, or once attempts have been failing
+// for maxDuration, whichever comes first. 0 leaves either unlimited, which is the default.
+// IsConnected then reports false until Reconnect succeeds, and queries fail without
+// further attempts, so a p0f that is gone for good does not keep p retrying forever.
+// Requires WithReconnect.
+func WithReconnectLimit(maxAttempts int, maxDuration time.Duration) Option {
+	return func(o *options) error {
+		if maxAttempts < 0 {
+			return errors.New("reconnect max attempts must not be negative")
+		}
+		if maxDuration < 0 {
+			return errors.New("reconnect max duration must not be negative")
+		}
+		o.reconnectMaxAttempts, o.reconnectMaxElapsed = maxAttempts, maxDuration
+		return nil
+	}
+}
+
+// Calls hook after each attempt to reconnect made with WithReconnect, with the number of
+// the attempt since the connection was lost, starting at 1, and its error, nil if it succeeded.
+// hook is called on the reconnecting goroutine, so it should not block. A nil hook is ignored.
+func WithReconnectHook(hook func(attempt int, err error)) Option {
+	return func(o *options) error {
+		o.reconnectHook = hook
+		return nil
+	}
+}
+
+// Calls hook after each successful reconnect, including those made by Reconnect.
+// With several connections (see WithConnections), it is called for each of them.
+// hook should not block. A nil hook is ignored.
+func WithReconnectedHook(hook func()) Option {
+	return func(o *options) error {
+		o.reconnectedHook = hook
+		return nil
+	}
+}
+
+// Sets how many queries may wait in the request queue for p0f.
+// Queries made while the queue is full fail immediately, unless WithBlockingEnqueue is used.
+// The default is 1024.
+func WithQueueSize(size int) Option {
+	return func(o *options) error {
+		if size <= 0 {
+			return errors.New("queue size must be positive")
+		}
+		o.queueSize = size
+		return nil
+	}
+}
+
+// Waits up to timeout for room in the request queue when it is full, rather than failing
+// right away with ErrQueueFull, so short bursts do not cause errors. QueryContext stops
+// waiting once its context is done. A timeout of 0 fails right away, which is the default.
+func WithBlockingEnqueue(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return errors.New("enqueue timeout must not be negative")
+		}
+		o.enqueueTimeout = timeout
+		return nil
+	}
+}
+
+// Sets the logger for errors that cannot be returned to a caller, such as failed reconnects.
+// The default is the standard logger of the log package. To silence them,
+// pass log.New(io.Discard, "", 0).
+func WithLogger(logger Logger) Option {
+	return func(o *options) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+		o.logger = logger
+		return nil
+	}
+}
+
+// Limits how long connecting to the p0f socket may take, in New and when reconnecting,
+// so a socket nothing accepts on fails New instead of hanging. The default is 5 seconds,
+// 0 waits for as long as the operating system allows.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return errors.New("dial timeout must not be negative")
+		}
+		o.dialTimeout = timeout
+		return nil
+	}
+}
+
+// Connects to p0f by calling dial instead of dialing the unix socket passed to New,
+// in New and when reconnecting. This reaches p0f wherever its API socket is made available,
+// such as over TCP through a socat bridge:
+//
+//	p0f.WithDialer(func() (net.Conn, error) {
+//		return net.DialTimeout("tcp", "p0f:1234", 5*time.Second)
+//	})
+//
+// The protocol is the same on any transport, but p0f uses the byte order of its host,
+// so bridging to p0f on a host of different endianness also needs WithByteOrder.
+// WithDialTimeout does not apply, dial should bound the time it takes itself.
+func WithDialer(dial func() (net.Conn, error)) Option {
+	return func(o *options) error {
+		if dial == nil {
+			return errors.New("dialer must not be nil")
+		}
+		o.dial = dial
+		return nil
+	}
+}
+
+// Sets the byte order of the multi-byte fields of requests and responses, including the magic
+// and status. p0f uses the byte order of the host it runs on, which is the default of
+// binary.NativeEndian as long as both run on the same host. Set it to the byte order of
+// the p0f host when reaching it from a host of different endianness, see WithDialer.
+func WithByteOrder(order binary.ByteOrder) Option {
+	return func(o *options) error {
+		if order == nil {
+			return errors.New("byte order must not be nil")
+		}
+		o.byteOrder = order
+		return nil
+	}
+}
+
+// Opens n connections to the p0f socket, each with its own goroutine taking queries from the
+// request queue, so up to n queries are answered in parallel. Combined with WithPipelineDepth,
+// up to n times depth queries are in flight. The default is a single connection.
+//
+// Each connection is reconnected on its own, Reconnect reconnects all of them.
+func WithConnections(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return errors.New("connections must be positive")
+		}
+		o.connections = n
+		return nil
+	}
+}
+
+// Traces every query with a span started by tracer, see Tracer.
+// Spans cover the cache lookup, the time in the request queue and the round trip to p0f,
+// and are children of the span in the context passed to QueryContext. The HTTP server
+// passes the request context, so spans are children of those of tracing middleware.
+func WithTracer(tracer Tracer) Option {
+	return func(o *options) error {
+		if tracer == nil {
+			return errors.New("tracer must not be nil")
+		}
+		o.tracer = tracer
+		return nil
+	}
+}
@@ -0,0 +1,81 @@
+package p0f
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// Most OS names remembered per IP. An address showing more is suspicious enough that the exact count does not matter.
+const maxDistinctOS = 32
+
+// LRU of the distinct OS names p0f reported for each IP, keyed by IP string.
+//
+// p0f only reports its latest match for a host, so this is the only record of earlier ones.
+// It is built from the queries made through this instance, and is lost on restart.
+type osHistory struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently updated
+}
+
+type osHistoryEntry struct {
+	key     string
+	osNames map[string]struct{}
+}
+
+func newOsHistory(maxEntries int) *osHistory {
+	return &osHistory{
+		max:     maxEntries,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Records that p0f reported osName for key, and returns the number of distinct names seen for it.
+func (h *osHistory) observe(key, osName string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, ok := h.entries[key]
+	if !ok {
+		elem = h.lru.PushFront(&osHistoryEntry{key: key, osNames: make(map[string]struct{})})
+		h.entries[key] = elem
+		if h.lru.Len() > h.max {
+			back := h.lru.Back()
+			h.lru.Remove(back)
+			delete(h.entries, back.Value.(*osHistoryEntry).key)
+		}
+	}
+	h.lru.MoveToFront(elem)
+	entry := elem.Value.(*osHistoryEntry)
+	if len(entry.osNames) < maxDistinctOS {
+		entry.osNames[osName] = struct{}{}
+	}
+	return len(entry.osNames)
+}
+
+// Returns the number of distinct OS names seen for key.
+func (h *osHistory) count(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if elem, ok := h.entries[key]; ok {
+		return len(elem.Value.(*osHistoryEntry).osNames)
+	}
+	return 0
+}
+
+// Returns the number of distinct OsName values p0f reported for ip across the queries
+// made through p, an indicator of NAT or fingerprint spoofing when above 1.
+// Requires WithOSHistory, otherwise 0 is returned.
+//
+// This is derived data and best-effort: only answers from p0f itself are counted, not cached ones,
+// addresses are forgotten once the history is full, and the history is lost when p is discarded.
+func (p *P0f) DistinctOSCount(ip net.IP) int {
+	if p.osHistory == nil {
+		return 0
+	}
+	return p.osHistory.count(ip.String())
+}
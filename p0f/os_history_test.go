@@ -0,0 +1,91 @@
+package p0f
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOsHistory(t *testing.T) {
+	h := newOsHistory(2)
+	for i, tt := range []struct {
+		key, osName string
+		want        int
+	}{
+		{"a", "Linux", 1},
+		{"a", "Linux", 1},
+		{"a", "Windows", 2},
+		{"b", "Linux", 1},
+		{"a", "Linux", 2}, // b is now the least recently updated
+		{"c", "Linux", 1},
+	} {
+		if got := h.observe(tt.key, tt.osName); got != tt.want {
+			t.Errorf("observe %d (%s, %s) = %d, want %d", i, tt.key, tt.osName, got, tt.want)
+		}
+	}
+	for key, want := range map[string]int{"a": 2, "b": 0, "c": 1} {
+		if got := h.count(key); got != want {
+			t.Errorf("count(%s) = %d, want %d", key, got, want)
+		}
+	}
+
+	for i := range 2 * maxDistinctOS {
+		h.observe("d", fmt.Sprintf("OS %d", i))
+	}
+	if got := h.count("d"); got != maxDistinctOS {
+		t.Errorf("count after %d OS names = %d, want the cap %d", 2*maxDistinctOS, got, maxDistinctOS)
+	}
+}
+
+func TestDistinctOSCount(t *testing.T) {
+	// Each answer reports the next OS name, as for an address shared by several hosts
+	osNames := []string{"Linux", "Windows", "Linux"}
+	var answered atomic.Int32
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(net.IP) []byte {
+		osName := osNames[int(answered.Add(1)-1)%len(osNames)]
+		return encodeResponse(binary.NativeEndian, resultOk, P0fResponse{OsName: &osName})
+	})
+	p, err := New(sockFile, WithOSHistory(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	if got := p.DistinctOSCount(ip); got != 0 {
+		t.Errorf("DistinctOSCount before querying = %d, want 0", got)
+	}
+	s := newTestServer(p, WithDistinctOSCount())
+	for i, want := range []int{1, 2, 2} {
+		w := httptest.NewRecorder()
+		s.serveQuery(w, httptest.NewRequest("GET", "/", nil))
+		var body struct{ DistinctOsCount *int }
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.DistinctOsCount == nil || *body.DistinctOsCount != want {
+			t.Errorf("query %d: distinctOsCount = %v, want %d", i, body.DistinctOsCount, want)
+		}
+		if got := p.DistinctOSCount(ip); got != want {
+			t.Errorf("query %d: DistinctOSCount = %d, want %d", i, got, want)
+		}
+	}
+
+	p, err = New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.DistinctOSCount(ip); got != 0 {
+		t.Errorf("DistinctOSCount without WithOSHistory = %d, want 0", got)
+	}
+}
@@ -1,21 +1,27 @@
 package p0f
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	requestChanSize = 1024 // Should be good enough for almost any use case
+	defaultQueueSize = 1024 // Should be good enough for almost any use case
 
-	requestSize  = 21
-	responseSize = 44 + (32 * 6)
+	defaultReadTimeout  = 5 * time.Second
+	defaultWriteTimeout = 5 * time.Second
+	defaultDialTimeout  = 5 * time.Second
+
+	RequestSize  = 21            // Size of a query frame in the p0f API
+	ResponseSize = 44 + (32 * 6) // Size of a response frame in the p0f API
 
 	ipv4Dword = 4
 	ipv6Dword = 6
@@ -24,223 +30,466 @@ const (
 	resultOk       = 0x10
 	resultNoMatch  = 0x20
 
+	matchFuzzy   = 0x01 // OsMatchQ bit: fuzzy signature match
+	matchGeneric = 0x02 // OsMatchQ bit: generic signature match
+
 	p0fStrMax = 32
 
 	magicBytesSend = uint32(0x50304601)
 	magicBytesRcv  = uint32(0x50304602)
 )
 
+var (
+	// Returned for queries made after Shutdown has been called.
+	ErrShutdown = errors.New("P0f::Shutdown previously called")
+
+	// Returned when p0f did not accept a query or answer it within the timeout set with
+	// WithWriteTimeout or WithReadTimeout. The connection is re-established afterwards.
+	ErrTimeout = errors.New("timed out waiting for p0f")
+
+	// Wraps the error of queries that failed because the connection to p0f was lost
+	// while WithReconnect is used. The connection is being re-established, so they may be retried.
+	ErrDisconnected = errors.New("p0f connection lost")
+
+	// Returned when p0f has no data for the queried IP address,
+	// usually because it has not seen traffic from it yet. This is an expected outcome, not a failure.
+	ErrNoMatch = errors.New("no match")
+
+	// Returned when p0f rejected the query as malformed.
+	ErrBadQuery = errors.New("bad query")
+
+	// Returned when the request queue is full, see WithQueueSize and WithBlockingEnqueue.
+	ErrQueueFull = errors.New("requestQueue at capacity")
+
+	// Returned by QueryString for strings that are not an IP address.
+	ErrInvalidIP = errors.New("invalid IP address")
+)
+
 type P0f struct {
-	conn         net.Conn
+	opts         options
+	sockFile     string
+	dial         func() (net.Conn, error)
+	workers      []*worker // One for each connection, see WithConnections
 	requestQueue chan *p0fRequest
+	queueMu      sync.RWMutex // Read locked while sending to requestQueue, locked to close it
 	shutdown     *atomic.Bool
+	closing      chan struct{} // Closed once Shutdown is called, to wake up blocked enqueues
+	closeOnce    sync.Once
+	stats        stats
+	cache        *cache       // nil unless WithCache is used
+	flights      *flightGroup // nil unless WithCoalesceWindow or WithSingleFlight is used
+	retries      *tokenBucket // nil unless WithRetryBudget is used
+	osHistory    *osHistory   // nil unless WithOSHistory is used
 }
 
 type p0fRequest struct {
-	ip net.IP
-	wg *sync.WaitGroup
+	ip     net.IP
+	done   chan struct{} // Closed once the request is completed, with response and err set
+	queued time.Time     // When the request was added to the queue
+	sent   time.Time     // When the request was written to p0f
+
+	inflight chan struct{} // The pipeline of the worker that sent the request, released once completed
+
+	// Set once the caller stopped waiting, see QueryContext.
+	// An abandoned request is not sent, but if it already was its response is still read.
+	abandoned atomic.Bool
 
 	response P0fResponse
 	err      error
 }
 
 type P0fResponse struct {
-	Ip         string  `json:"ip"`         // IP address
-	FirstSeen  uint32  `json:"firstSeen"`  // First seen (unix time)
-	LastSeen   uint32  `json:"lastSeen"`   // Last seen (unix time)
-	TotalCount uint32  `json:"totalCount"` // Total connections seen
-	UptimeMin  uint32  `json:"uptimeMin"`  // Last uptime (minutes)
-	UpModDays  uint32  `json:"upModDays"`  // Uptime modulo (days)
-	LastNat    uint32  `json:"lastNat"`    // NAT / LB last detected (unix time)
-	LastChg    uint32  `json:"lastChg"`    // OS chg last detected (unix time)
-	Distance   uint16  `json:"distance"`   // System distance
-	BadSw      byte    `json:"badSW"`      // Host is lying about U-A / Server
-	OsMatchQ   byte    `json:"osMatchQ"`   // Match quality
-	OsName     *string `json:"osName"`     // Name of detected OS
-	OsFlavor   *string `json:"osFlavor"`   // Flavor of detected OS
-	HttpName   *string `json:"httpName"`   // Name of detected HTTP app
-	HttpFlavor *string `json:"httpFlavor"` // Flavor of detected HTTP app
-	LinkMtu    uint16  `json:"linkMtu"`    // Link MTU value
-	LinkType   *string `json:"linkType"`   // Link type
-	Language   *string `json:"language"`   // Language
+	Ip         string    `json:"ip"`              // IP address
+	FirstSeen  uint32    `json:"firstSeen"`       // First seen (unix time)
+	LastSeen   uint32    `json:"lastSeen"`        // Last seen (unix time)
+	TotalCount uint32    `json:"totalCount"`      // Total connections seen
+	UptimeMin  uint32    `json:"uptimeMin"`       // Last uptime (minutes)
+	UpModDays  uint32    `json:"upModDays"`       // Uptime modulo (days)
+	LastNat    uint32    `json:"lastNat"`         // NAT / LB last detected (unix time)
+	LastChg    uint32    `json:"lastChg"`         // OS chg last detected (unix time)
+	Distance   uint16    `json:"distance"`        // System distance
+	BadSw      byte      `json:"badSW"`           // Host is lying about U-A / Server
+	OsMatchQ   byte      `json:"osMatchQ"`        // Match quality
+	OsName     *string   `json:"osName"`          // Name of detected OS
+	OsFlavor   *string   `json:"osFlavor"`        // Flavor of detected OS
+	HttpName   *string   `json:"httpName"`        // Name of detected HTTP app
+	HttpFlavor *string   `json:"httpFlavor"`      // Flavor of detected HTTP app
+	LinkMtu    uint16    `json:"linkMtu"`         // Link MTU value
+	LinkType   *string   `json:"linkType"`        // Link type
+	Language   *string   `json:"language"`        // Language
+	LinkClass  LinkClass `json:"linkClass"`       // Normalized LinkType
+	Flags      []string  `json:"flags"`           // Risk indicators, see the Flag constants
+	Stale      bool      `json:"stale,omitempty"` // Served from cache because p0f was unavailable
 }
 
 // unixSocketFile is the path to the UNIX socket file.
 // This is opened when p0f is started (-s argument)
-func New(unixSocketFile string) (*P0f, error) {
-	conn, err := net.Dial("unix", unixSocketFile)
-	if err != nil {
-		return nil, err
+// A name starting with @ is a Linux abstract socket (example: @p0f), no file is involved then.
+// It is not used with WithDialer, and may be empty then.
+//
+// opts are applied in order. If any option is invalid, an error is returned.
+func New(unixSocketFile string, opts ...Option) (*P0f, error) {
+	o := options{
+		queueSize:    defaultQueueSize,
+		readTimeout:  defaultReadTimeout,
+		writeTimeout: defaultWriteTimeout,
+		dialTimeout:  defaultDialTimeout,
+		logger:       log.Default(),
+		byteOrder:    binary.NativeEndian,
+	}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	if o.staleTTL > 0 && o.cacheTTL == 0 {
+		return nil, errors.New("WithStaleOnError requires WithCache")
+	}
+	if (o.reconnectMaxAttempts > 0 || o.reconnectMaxElapsed > 0) && o.reconnectMax == 0 {
+		return nil, errors.New("WithReconnectLimit requires WithReconnect")
+	}
+	if o.negativeCache {
+		if o.cacheTTL == 0 {
+			return nil, errors.New("WithNegativeCache requires WithCache")
+		}
+		if o.negativeTTL == 0 {
+			o.negativeTTL = o.cacheTTL / 10
+		}
+	}
+
+	dial := o.dial
+	if dial == nil {
+		dial = func() (net.Conn, error) {
+			return net.DialTimeout("unix", unixSocketFile, o.dialTimeout)
+		}
+	}
+	conns := make([]net.Conn, max(o.connections, 1))
+	for i := range conns {
+		conn, err := dial()
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns[i] = conn
 	}
 	p0f := &P0f{
-		conn:         conn,
-		requestQueue: make(chan *p0fRequest, requestChanSize),
+		opts:         o,
+		sockFile:     unixSocketFile,
+		dial:         dial,
+		requestQueue: make(chan *p0fRequest, o.queueSize),
 		shutdown:     &atomic.Bool{},
+		closing:      make(chan struct{}),
+	}
+	if o.cacheTTL > 0 {
+		p0f.cache = newCache(o.cacheTTL, o.staleTTL, o.negativeTTL, o.cacheMaxEntries)
+	}
+	if o.coalesceWindow > 0 || o.singleFlight {
+		p0f.flights = newFlightGroup(o.coalesceWindow)
+	}
+	if o.osHistoryMaxIPs > 0 {
+		p0f.osHistory = newOsHistory(o.osHistoryMaxIPs)
+	}
+	if o.retryRate > 0 {
+		p0f.retries = newTokenBucket(o.retryRate, o.retryBurst)
+	}
+	for _, conn := range conns {
+		w := &worker{inflight: make(chan struct{}, max(o.pipelineDepth, 1))}
+		w.conn = p0f.newConn(w, conn)
+		p0f.workers = append(p0f.workers, w)
+		go p0f.start(w)
 	}
-	go p0f.start()
 	return p0f, nil
 }
 
 // Queries p0f for the given IP address.
 // This function blocks the calling goroutine until completed.
+//
+// If caching is enabled, a fresh cached response is returned without querying p0f.
 func (p *P0f) Query(ip net.IP) (response P0fResponse, err error) {
-	if p.shutdown.Load() {
-		err = errors.New("P0f::Shutdown previously called")
-		return
-	}
+	return p.QueryContext(context.Background(), ip)
+}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	request := &p0fRequest{ip: ip, wg: wg}
+// Same as Query, reporting a no match result as found being false rather than as ErrNoMatch,
+// so err is only set for actual failures.
+func (p *P0f) Lookup(ip net.IP) (response P0fResponse, found bool, err error) {
+	response, err = p.Query(ip)
+	if errors.Is(err, ErrNoMatch) {
+		return P0fResponse{}, false, nil
+	}
+	return response, err == nil, err
+}
 
-	select {
-	case p.requestQueue <- request:
-		wg.Wait() // wait for request to finish
-		response, err = request.response, request.err
-		return
-	default:
-		return response, errors.New("requestQueue at capacity")
+// Same as Query, for an IP address in text form, such as from a header or a command line argument.
+// Surrounding whitespace and brackets ("[2001:db8::1]") are ignored, and IPv4-mapped IPv6
+// addresses ("::ffff:192.0.2.1") are queried as the IPv4 address they map.
+// An error wrapping ErrInvalidIP is returned if ip is not an IP address.
+func (p *P0f) QueryString(ip string) (P0fResponse, error) {
+	s := strings.TrimSpace(ip)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	parsed := net.ParseIP(s)
+	if parsed == nil {
+		return P0fResponse{}, fmt.Errorf("%w: %q", ErrInvalidIP, ip)
 	}
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+	}
+	return p.Query(parsed)
 }
 
-// Shut down p0f. After this, calls to Query will fail.
-// This should only be called once. Subsequent calls to Shutdown have no effect.
-func (p *P0f) Shutdown() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("error in Shutdown:", r)
+// Same as Query, but returns ctx.Err() as soon as ctx is done,
+// whether the query is still waiting in the queue or for its response from p0f.
+//
+// A query abandoned before it was sent is never sent. One abandoned after being sent
+// still has its response read, so later responses stay aligned with their queries.
+func (p *P0f) QueryContext(ctx context.Context, ip net.IP) (response P0fResponse, err error) {
+	response, _, err = p.queryContext(ctx, ip)
+	return
+}
+
+// Where a response came from, see P0f.queryContext.
+type queryInfo struct {
+	queried time.Time // When p0f answered
+	cached  bool      // Served from the cache, including stale responses
+}
+
+// Same as QueryContext, also reporting where the response came from.
+func (p *P0f) queryContext(ctx context.Context, ip net.IP) (response P0fResponse, info queryInfo, err error) {
+	ctx, endSpan := p.traceQuery(ctx, ip)
+	defer func() { endSpan(response, info.cached, err) }()
+
+	if p.cache == nil {
+		response, err = p.fetch(ctx, ip)
+		return response, queryInfo{queried: time.Now()}, err
+	}
+	key := ip.String()
+	if entry, ok := p.cache.get(key); ok {
+		info = queryInfo{queried: entry.queried, cached: true}
+		if entry.noMatch {
+			return P0fResponse{}, info, ErrNoMatch
 		}
-	}()
-	if p.shutdown.CompareAndSwap(false, true) {
-		close(p.requestQueue)
+		return entry.response, info, nil
 	}
+	response, err = p.fetch(ctx, ip)
+	info.queried = time.Now()
+	p.cache.store(key, response, err)
+	switch err {
+	case nil, ErrNoMatch, ErrBadQuery, ErrShutdown, context.Canceled, context.DeadlineExceeded:
+	default:
+		// p0f is unavailable, fall back to the last known answer
+		if stale, ok := p.cache.getStale(key); ok {
+			p.stats.stale.Add(1)
+			stale.response.Stale = true
+			return stale.response, queryInfo{queried: stale.queried, cached: true}, nil
+		}
+	}
+	return
+}
+
+// Queries p0f for the given IP address, ignoring the cache and any coalesced results,
+// for when the freshest data is needed. If caching is enabled,
+// the cache is still updated with the result.
+func (p *P0f) QueryFresh(ip net.IP) (response P0fResponse, err error) {
+	return p.QueryFreshContext(context.Background(), ip)
 }
 
-// Long running background routine that processes requests
-// and delivers them back to waiting goroutines.
-func (p *P0f) start() {
-	defer p.conn.Close()
+// Same as QueryFresh, with a context for tracing and cancellation as with QueryContext.
+func (p *P0f) QueryFreshContext(ctx context.Context, ip net.IP) (response P0fResponse, err error) {
+	ctx, endSpan := p.traceQuery(ctx, ip)
+	defer func() { endSpan(response, false, err) }()
 
-	for !p.shutdown.Load() {
-		request, ok := <-p.requestQueue
-		if !ok {
-			// Channel closed, exit
-			return
-		}
+	response, err = p.query(ctx, ip)
+	if p.cache != nil {
+		p.cache.store(ip.String(), response, err)
+	}
+	return
+}
 
-		func() {
-			defer request.wg.Done()
-			if err := p.writeRequest(request); err != nil {
-				request.err = err
-				return
-			}
-			request.response, request.err = p.readResponse(request.ip.String())
-		}()
+// Queries p0f for the given IP address and stores the result in the cache,
+// without returning it. This is meant for loops keeping cache entries warm.
+// ctx is used for tracing and cancellation as with QueryContext.
+// An error is returned without querying p0f if caching is not enabled.
+func (p *P0f) Touch(ctx context.Context, ip net.IP) error {
+	if p.cache == nil {
+		return errors.New("Touch requires WithCache")
 	}
+	_, err := p.QueryFreshContext(ctx, ip)
+	return err
 }
 
-func (p *P0f) writeRequest(request *p0fRequest) (err error) {
-	buffer := [requestSize]byte{}
-	binary.NativeEndian.PutUint32(buffer[0:4], magicBytesSend)
+// Queries p0f for each of ips at once, waiting for all of them to complete.
+// The responses and errors are returned in the order of ips,
+// so the query for ips[i] failed if errs[i] is non-nil.
+//
+// Cached responses are used as with Query, the other addresses are queued together.
+// Addresses that do not fit in the request queue fail individually.
+func (p *P0f) QueryBatch(ips []net.IP) (responses []P0fResponse, errs []error) {
+	responses, errs = make([]P0fResponse, len(ips)), make([]error, len(ips))
+	requests := make([]*p0fRequest, len(ips))
+	for i, ip := range ips {
+		if p.cache != nil {
+			if entry, ok := p.cache.get(ip.String()); ok {
+				responses[i] = entry.response
+				if entry.noMatch {
+					errs[i] = ErrNoMatch
+				}
+				continue
+			}
+		}
+		request := newRequest(ip)
+		if errs[i] = p.enqueue(context.Background(), request); errs[i] != nil {
+			continue
+		}
+		requests[i] = request
+	}
 
-	if ip4 := request.ip.To4(); ip4 != nil {
-		buffer[4] = ipv4Dword
-		for i, b := range ip4 {
-			buffer[5+i] = b
+	for i, request := range requests {
+		if request == nil {
+			continue
 		}
-	} else {
-		buffer[4] = ipv6Dword
-		for i, b := range request.ip.To16() {
-			buffer[5+i] = b
+		<-request.done
+		responses[i], errs[i] = request.response, request.err
+		if p.cache != nil {
+			p.cache.store(request.ip.String(), request.response, request.err)
 		}
 	}
-	_, err = p.conn.Write(buffer[:])
 	return
 }
 
-func (p *P0f) readResponse(ip string) (resp P0fResponse, err error) {
-	// Temp struct to avoid returning Magic and Status (which are always the same on success),
-	// as well as removing null terminators from the strings
-	var r struct {
-		Magic      uint32          // Must be magicBytesRcv
-		Status     uint32          // result*
-		FirstSeen  uint32          // First seen (unix time)
-		LastSeen   uint32          // Last seen (unix time)
-		TotalCount uint32          // Total connections seen
-		UptimeMin  uint32          // Last uptime (minutes)
-		UpModDays  uint32          // Uptime modulo (days)
-		LastNat    uint32          // NAT / LB last detected (unix time)
-		LastChg    uint32          // OS chg last detected (unix time)
-		Distance   uint16          // System distance
-		BadSw      byte            // Host is lying about U-A / Server
-		OsMatchQ   byte            // Match quality
-		OsName     [p0fStrMax]byte // Name of detected OS
-		OsFlavor   [p0fStrMax]byte // Flavor of detected OS
-		HttpName   [p0fStrMax]byte // Name of detected HTTP app
-		HttpFlavor [p0fStrMax]byte // Flavor of detected HTTP app
-		LinkMtu    uint16          // Link MTU value
-		LinkType   [p0fStrMax]byte // Link type
-		Language   [p0fStrMax]byte // Language
-	}
-
-	responseBytes := make([]byte, responseSize)
-
-	if _, err = p.conn.Read(responseBytes); err != nil {
-		return
+// Queries each of ips in order and returns the response for the first one p0f has a match for.
+// This is meant for clients reported under several addresses, such as proxies passing both
+// an IPv4 and an IPv6 address.
+//
+// A no match error is returned only if none of ips matched.
+// If p0f could not be queried for some of them, the first such error is returned instead,
+// as those addresses might have matched.
+func (p *P0f) QueryPreferred(ips ...net.IP) (response P0fResponse, err error) {
+	if len(ips) == 0 {
+		return response, errors.New("no IP addresses given")
+	}
+	var queryErr error
+	for _, ip := range ips {
+		response, err = p.Query(ip)
+		switch err {
+		case nil:
+			return response, nil
+		case ErrNoMatch:
+		default:
+			if queryErr == nil {
+				queryErr = err
+			}
+		}
 	}
-	if err = binary.Read(bytes.NewReader(responseBytes), binary.NativeEndian, &r); err != nil {
+	if queryErr != nil {
+		return P0fResponse{}, queryErr
+	}
+	return P0fResponse{}, ErrNoMatch
+}
+
+// Queries p0f for the given IP address like Query
+// and converts the response into a caller defined type using mapper.
+// mapper is only called if the query succeeds.
+//
+//	type hop struct{ Distance uint16 }
+//	h, err := p0f.QueryAs(p, ip, func(r p0f.P0fResponse) hop {
+//		return hop{Distance: r.Distance}
+//	})
+func QueryAs[T any](p *P0f, ip net.IP, mapper func(P0fResponse) T) (out T, err error) {
+	response, err := p.Query(ip)
+	if err != nil {
 		return
 	}
-	if r.Magic != magicBytesRcv {
-		err = errors.New("invalid magic bytes in response")
+	return mapper(response), nil
+}
+
+func newRequest(ip net.IP) *p0fRequest {
+	return &p0fRequest{ip: ip, done: make(chan struct{})}
+}
+
+// Queries p0f, sharing the result with concurrent callers if coalescing is enabled.
+func (p *P0f) fetch(ctx context.Context, ip net.IP) (P0fResponse, error) {
+	if p.flights == nil {
+		return p.query(ctx, ip)
+	}
+	return p.flights.do(ctx, ip.String(), func() (P0fResponse, error) {
+		// Shared with other callers, so it must not be cancelled with this one
+		return p.query(context.WithoutCancel(ctx), ip)
+	})
+}
+
+// Sends a query to the p0f socket, bypassing the cache.
+func (p *P0f) query(ctx context.Context, ip net.IP) (response P0fResponse, err error) {
+	if err = ctx.Err(); err != nil {
 		return
 	}
-	switch r.Status {
-	case resultOk:
-		resp = P0fResponse{
-			Ip:         ip,
-			FirstSeen:  r.FirstSeen,
-			LastSeen:   r.LastSeen,
-			TotalCount: r.TotalCount,
-			UptimeMin:  r.UptimeMin,
-			UpModDays:  r.UpModDays,
-			LastNat:    r.LastNat,
-			LastChg:    r.LastChg,
-			Distance:   r.Distance,
-			BadSw:      r.BadSw,
-			OsMatchQ:   r.OsMatchQ,
-			OsName:     trstr(r.OsName),
-			OsFlavor:   trstr(r.OsFlavor),
-			HttpName:   trstr(r.HttpName),
-			HttpFlavor: trstr(r.HttpFlavor),
-			LinkMtu:    r.LinkMtu,
-			LinkType:   trstr(r.LinkType),
-			Language:   trstr(r.Language),
-		}
+
+	request := newRequest(ip)
+	if err = p.enqueue(ctx, request); err != nil {
 		return
-	case resultBadQuery:
-		err = errors.New("bad query")
-	case resultNoMatch:
-		err = errors.New("no match")
-	default:
-		err = fmt.Errorf("unknown response code %d", r.Status)
 	}
-	return
+
+	select {
+	case <-request.done:
+		return request.response, request.err
+	case <-ctx.Done():
+		// Written or not, the request is left to start() and readLoop, which no longer deliver to us
+		request.abandoned.Store(true)
+		p.stats.abandoned.Add(1)
+		return P0fResponse{}, ctx.Err()
+	}
 }
 
-func trstr(cStr [p0fStrMax]byte) *string {
-	// if first byte is null the string is null
-	if cStr[0] == 0 {
+// Adds request to the request queue, failing if it is full or p was shut down.
+func (p *P0f) enqueue(ctx context.Context, request *p0fRequest) error {
+	// Shutdown closes the queue with queueMu held, so it cannot be closed while sending
+	p.queueMu.RLock()
+	defer p.queueMu.RUnlock()
+	if p.shutdown.Load() {
+		return ErrShutdown
+	}
+	request.queued = time.Now()
+	select {
+	case p.requestQueue <- request:
+		p.stats.queries.Add(1)
 		return nil
+	default:
+	}
+	if p.opts.enqueueTimeout > 0 {
+		timer := time.NewTimer(p.opts.enqueueTimeout)
+		defer timer.Stop()
+		select {
+		case p.requestQueue <- request:
+			p.stats.queries.Add(1)
+			return nil
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.closing:
+			return ErrShutdown
+		}
 	}
-	for i := 1; i < len(cStr); i++ {
-		if cStr[i] == 0 {
-			// return new string with null bytes ignored
-			goStr := string(cStr[0:i])
-			return &goStr
+	p.stats.queueFull.Add(1)
+	return ErrQueueFull
+}
+
+// Shut down p0f. After this, calls to Query will fail.
+// Queries still waiting in the request queue fail with ErrShutdown,
+// queries already sent to p0f are completed before the connections are closed.
+// This should only be called once. Subsequent calls to Shutdown have no effect.
+func (p *P0f) Shutdown() {
+	defer func() {
+		if r := recover(); r != nil {
+			p.opts.logger.Printf("error in Shutdown: %v", r)
 		}
+	}()
+	// Blocked enqueues hold queueMu until they give up, don't wait for their timeout
+	p.closeOnce.Do(func() { close(p.closing) })
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	if p.shutdown.CompareAndSwap(false, true) {
+		close(p.requestQueue)
 	}
-	// All 32 bytes are not null, return full 32 char String
-	goStr := string(cStr[:])
-	return &goStr
 }
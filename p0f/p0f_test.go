@@ -0,0 +1,713 @@
+package p0f
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves a fake p0f on sockFile, answering every query with a match first seen at firstSeen,
+
+// until stop is called. stop closes the listener and every connection accepted.
+func serveMatches(tb testing.TB, sockFile string, firstSeen uint32) (stop func()) {
+	return serveResponses(tb, sockFile, nil, func(net.IP) []byte { return matchResponse(firstSeen, 0) })
+}
+
+// Serves a unix socket answering one query at a time, each for a value received on answer,
+
+// or right away once answer is closed, for tests controlling how the queue drains.
+func serveOnAnswer(tb testing.TB) (sockFile string, answer chan struct{}) {
+	answer = make(chan struct{})
+	sockFile = filepath.Join(tb.TempDir(), "p0f.sock")
+	serveResponses(tb, sockFile, answer, func(net.IP) []byte { return matchResponse(1234, 0) })
+	return sockFile, answer
+}
+
+// Serves a fake p0f on sockFile, writing respond(ip) for each query, once a value is received
+
+// on answer if it is not nil. stop closes the listener and every connection accepted.
+func serveResponses(tb testing.TB, sockFile string, answer <-chan struct{}, respond func(ip net.IP) []byte) (stop func()) {
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				request := make([]byte, RequestSize)
+				for {
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return
+					}
+					if answer != nil {
+						<-answer
+					}
+					ip := net.IP(request[5:21])
+					if request[4] == ipv4Dword {
+						ip = net.IP(request[5:9])
+					}
+					if _, err := conn.Write(respond(ip)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	stop = func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	tb.Cleanup(stop)
+	return stop
+}
+
+// Returns the response of p0f for a match first seen at firstSeen, distance hops away.
+func matchResponse(firstSeen uint32, distance uint16) []byte {
+	response := make([]byte, ResponseSize)
+	binary.NativeEndian.PutUint32(response[0:4], magicBytesRcv)
+	binary.NativeEndian.PutUint32(response[4:8], resultOk)
+	binary.NativeEndian.PutUint32(response[8:12], firstSeen)
+	binary.NativeEndian.PutUint16(response[36:38], distance)
+	return response
+}
+
+// Returns the response of p0f for an address it has no data for.
+func noMatchResponse() []byte {
+	response := make([]byte, ResponseSize)
+	binary.NativeEndian.PutUint32(response[0:4], magicBytesRcv)
+	binary.NativeEndian.PutUint32(response[4:8], resultNoMatch)
+	return response
+}
+
+func TestIdleReconnect(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveMatches(t, sockFile, 1234)
+	p, err := New(sockFile, WithIdleReconnect(idle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	query := func() {
+		t.Helper()
+		ip := net.ParseIP("192.0.2.1")
+		response, err := p.Query(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.FirstSeen != 1234 {
+			t.Fatalf("Query(%s) got FirstSeen %d, want 1234", ip, response.FirstSeen)
+		}
+	}
+	query()
+	query()
+	if got := p.Stats().Reconnects; got != 0 {
+		t.Fatalf("%d reconnects after back to back queries, want 0", got)
+	}
+	time.Sleep(2 * idle)
+	query()
+	if got := p.Stats().Reconnects; got != 1 {
+		t.Fatalf("%d reconnects after the connection was idle, want 1", got)
+	}
+}
+
+func TestQueryPreferred(t *testing.T) {
+	distances := map[string]uint16{"192.0.2.1": 12, "2001:db8::1": 6}
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(ip net.IP) []byte {
+		if distance, ok := distances[ip.String()]; ok {
+			return matchResponse(1234, distance)
+		}
+		return noMatchResponse()
+	})
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	unknown, v4, v6 := net.ParseIP("198.51.100.7"), net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	for _, test := range []struct {
+		ips          []net.IP
+		wantDistance uint16
+	}{
+		{[]net.IP{v6, v4}, 6},
+		{[]net.IP{v4, v6}, 12},
+		{[]net.IP{unknown, v6, v4}, 6},
+	} {
+		if r, err := p.QueryPreferred(test.ips...); err != nil || r.Distance != test.wantDistance {
+			t.Errorf("QueryPreferred(%v) = %+v, %v, want distance %d", test.ips, r, err, test.wantDistance)
+		}
+	}
+	if _, err := p.QueryPreferred(unknown, net.ParseIP("198.51.100.8")); err != ErrNoMatch {
+		t.Errorf("QueryPreferred without a match error = %v, want %v", err, ErrNoMatch)
+	}
+	if _, err := p.QueryPreferred(); err == nil || err == ErrNoMatch {
+		t.Errorf("QueryPreferred() error = %v, want an error other than %v", err, ErrNoMatch)
+	}
+
+	// A failed query might have matched, so its error takes precedence over no match
+	p.Shutdown()
+	if _, err := p.QueryPreferred(unknown, v4); err != ErrShutdown {
+		t.Errorf("QueryPreferred after Shutdown error = %v, want %v", err, ErrShutdown)
+	}
+}
+
+// A frame with bad magic bytes fails its query and makes the client start over on a new connection,
+
+// so later queries are not answered with responses meant for others.
+func TestBadMagicResync(t *testing.T) {
+	var responses atomic.Int32
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(ip net.IP) []byte {
+		// A match first seen at the last byte of the address, telling responses apart
+		frame := matchResponse(uint32(ip.To4()[3]), 0)
+		if responses.Add(1) == 2 {
+			binary.NativeEndian.PutUint32(frame, 0xdeadbeef)
+		}
+		return frame
+	})
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	if _, err := p.Query(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Query(net.ParseIP("192.0.2.2")); err != errBadMagic {
+		t.Fatalf("Query answered with bad magic bytes error = %v, want %v", err, errBadMagic)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for i := 3; i < 20; i++ {
+		ip := net.IPv4(192, 0, 2, byte(i))
+		response, err := p.Query(ip)
+		if err != nil {
+			// Queries sent before the reconnect fail along with the misaligned connection
+			if time.Now().After(deadline) {
+				t.Fatalf("Query(%s) still failing after the resync: %v", ip, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if response.FirstSeen != uint32(i) {
+			t.Fatalf("Query(%s) after the resync got FirstSeen %d, want %d", ip, response.FirstSeen, i)
+		}
+	}
+	if stats := p.Stats(); stats.Resyncs != 1 || stats.Reconnects != 1 {
+		t.Fatalf("Stats() = %+v, want 1 resync and 1 reconnect", stats)
+	}
+}
+
+func TestQueryContextAbandoned(t *testing.T) {
+	sockFile := serveDelayed(t, 100*time.Millisecond)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	// The first query is written and then abandoned, the second one is abandoned while queued
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 2)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		go func() {
+			_, err := p.QueryContext(ctx, net.ParseIP(ip))
+			errs <- err
+		}()
+	}
+	for range 2 {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("QueryContext error = %v, want %v", err, context.DeadlineExceeded)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("QueryContext did not return once its context was done")
+		}
+	}
+
+	// The response to the abandoned query must not be handed to the next one
+	for _, ip := range []net.IP{net.ParseIP("198.51.100.7"), net.ParseIP("2001:db8::1")} {
+		response, err := p.Query(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := syntheticResponse(ip); response.FirstSeen != want.FirstSeen {
+			t.Fatalf("Query(%s) got FirstSeen %d, want %d", ip, response.FirstSeen, want.FirstSeen)
+		}
+	}
+	if got := p.Stats().Abandoned; got != 2 {
+		t.Fatalf("Stats().Abandoned = %d, want 2", got)
+	}
+}
+
+func TestQueryReadTimeout(t *testing.T) {
+	// The first connection answers after the read timeout, the next ones right away
+	sockFile := serveConns(t, func(n int, conn net.Conn) {
+		for ip := range readRequests(conn) {
+			if n == 0 {
+				time.Sleep(1500 * time.Millisecond)
+			}
+			if _, err := conn.Write(encodeResponse(binary.NativeEndian, resultOk, syntheticResponse(ip))); err != nil {
+				return
+			}
+		}
+	})
+	p, err := New(sockFile, WithReadTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	if _, err := p.Query(net.ParseIP("192.0.2.1")); err != ErrTimeout {
+		t.Fatalf("Query error = %v, want %v", err, ErrTimeout)
+	}
+	for deadline := time.Now().Add(time.Second); p.Stats().Reconnects == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no reconnect after a timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The late response to the timed out query must not be handed to the next one
+	ip := net.ParseIP("198.51.100.7")
+	response, err := p.Query(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := syntheticResponse(ip); response.FirstSeen != want.FirstSeen {
+		t.Fatalf("Query(%s) got FirstSeen %d, want %d", ip, response.FirstSeen, want.FirstSeen)
+	}
+}
+
+// Serves synthetic responses on a unix socket until the returned function is called,
+
+// which closes the listener and every connection, as a p0f restart would.
+func serveSynthetic(tb testing.TB, sockFile string) (stop func()) {
+	l, err := net.Listen("unix", sockFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go serveSyntheticConn(conn, binary.NativeEndian, nil)
+		}
+	}()
+	stop = func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	tb.Cleanup(stop)
+	return stop
+}
+
+func TestQueryReconnect(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	stop := serveSynthetic(t, sockFile)
+	var failedAttempts, reconnected atomic.Int32
+	p, err := New(sockFile, WithReconnect(10*time.Millisecond, 50*time.Millisecond), WithLogger(log.New(io.Discard, "", 0)),
+		WithReconnectHook(func(attempt int, err error) {
+			if err != nil {
+				failedAttempts.Add(1)
+			}
+		}),
+		WithReconnectedHook(func() { reconnected.Add(1) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if p.SocketFile() != sockFile {
+		t.Fatalf("SocketFile() = %q, want %q", p.SocketFile(), sockFile)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsConnected() {
+		t.Fatal("IsConnected() = false after a query was answered")
+	}
+	stop()
+	if _, err := p.Query(ip); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("Query error after p0f stopped = %v, want %v", err, ErrDisconnected)
+	}
+	if p.IsConnected() {
+		t.Fatal("IsConnected() = true after p0f stopped")
+	}
+
+	// Some attempts to reconnect fail before p0f is back
+	time.Sleep(100 * time.Millisecond)
+	serveSynthetic(t, sockFile)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := p.Query(ip)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrDisconnected) || time.Now().After(deadline) {
+			t.Fatalf("Query error after p0f restarted = %v", err)
+		}
+	}
+	if p.Stats().Reconnects == 0 {
+		t.Fatal("Stats().Reconnects = 0 after reconnecting")
+	}
+	if failedAttempts.Load() == 0 || reconnected.Load() != 1 {
+		t.Errorf("hooks saw %d failed attempts and %d reconnects, want some and 1", failedAttempts.Load(), reconnected.Load())
+	}
+	if !p.IsConnected() {
+		t.Fatal("IsConnected() = false after reconnecting")
+	}
+	p.Shutdown()
+	if p.IsConnected() {
+		t.Fatal("IsConnected() = true after Shutdown")
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are Linux only")
+	}
+	name := fmt.Sprintf("@p0f-go-test-%d", os.Getpid())
+	defer serveSynthetic(t, name)()
+	p, err := New(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if _, err := p.Query(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatalf("Query over an abstract socket error = %v", err)
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{
+		"192.0.2.1": {OsName: syntheticString("Linux")},
+		"192.0.2.3": {OsName: syntheticString("Windows")},
+	}), WithPipelineDepth(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}
+	responses, errs := p.QueryBatch(ips)
+	if errs[0] != nil || *responses[0].OsName != "Linux" {
+		t.Errorf("QueryBatch[0] = %v, %v, want Linux", responses[0].OsName, errs[0])
+	}
+	if errs[1] != ErrNoMatch {
+		t.Errorf("QueryBatch[1] error = %v, want %v", errs[1], ErrNoMatch)
+	}
+	if errs[2] != nil || *responses[2].OsName != "Windows" {
+		t.Errorf("QueryBatch[2] = %v, %v, want Windows", responses[2].OsName, errs[2])
+	}
+}
+
+func TestQueryShutdownRace(t *testing.T) {
+	for range 20 {
+		p, err := New("", WithSynthetic(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var wg sync.WaitGroup
+		for i := range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := p.QueryContext(ctx, net.IPv4(192, 0, 2, byte(i)))
+				switch err {
+				case nil, ErrShutdown, ErrQueueFull:
+				default:
+					t.Errorf("Query error = %v", err)
+				}
+			}()
+		}
+		p.Shutdown()
+		wg.Wait()
+		cancel()
+	}
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	sockFile := serveDelayed(t, 50*time.Millisecond)
+	p, err := New(sockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := range n {
+		go func() {
+			_, err := p.Query(net.IPv4(192, 0, 2, byte(i)))
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // one query is sent, the others are queued
+	p.Shutdown()
+
+	shutdowns := 0
+	for range n {
+		select {
+		case err := <-errs:
+			switch err {
+			case nil:
+			case ErrShutdown:
+				shutdowns++
+			default:
+				t.Errorf("Query error = %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Query did not return after Shutdown")
+		}
+	}
+	if shutdowns == 0 {
+		t.Error("no queued query failed with ErrShutdown")
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	for _, ip := range []string{"192.0.2.1", " 192.0.2.1\n", "::ffff:192.0.2.1", "[2001:db8::1]", "2001:db8::1"} {
+		if _, err := p.QueryString(ip); err != nil {
+			t.Errorf("QueryString(%q) error = %v", ip, err)
+		}
+	}
+	for _, ip := range []string{"", "192.0.2", "example.com", "192.0.2.1:80"} {
+		if _, err := p.QueryString(ip); !errors.Is(err, ErrInvalidIP) {
+			t.Errorf("QueryString(%q) error = %v, want %v", ip, err, ErrInvalidIP)
+		}
+	}
+}
+
+func TestQuerySingleFlight(t *testing.T) {
+	sockFile := serveDelayed(t, 50*time.Millisecond)
+	p, err := New(sockFile, WithSingleFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Query(ip); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if queries := p.Stats().Queries; queries != 1 {
+		t.Fatalf("concurrent queries sent %d requests to p0f, want 1", queries)
+	}
+	if _, err := p.Query(ip); err != nil {
+		t.Fatal(err)
+	}
+	if queries := p.Stats().Queries; queries != 2 {
+		t.Fatalf("query after the shared one completed sent %d requests in total, want 2", queries)
+	}
+}
+
+// Returns a P0f with a queue of 1 that is full, answering each query latency after it was sent.
+func newFullQueue(t *testing.T, latency time.Duration, opts ...Option) *P0f {
+	p, err := New(serveDelayed(t, latency), append(opts, WithQueueSize(1))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+
+	// The first query is taken by the worker, the second one fills the queue
+	go p.Query(net.ParseIP("192.0.2.1"))
+	for s := p.Stats(); s.Queries != 1 || s.QueueLen != 0; s = p.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	go p.Query(net.ParseIP("192.0.2.2"))
+	for p.Stats().QueueLen != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	return p
+}
+
+func TestQueueSize(t *testing.T) {
+	if _, err := New("", WithSynthetic(nil), WithQueueSize(0)); err == nil {
+		t.Fatal("New with a queue size of 0 succeeded, want an error")
+	}
+
+	p := newFullQueue(t, 200*time.Millisecond)
+	if _, err := p.Query(net.ParseIP("192.0.2.3")); err != ErrQueueFull {
+		t.Fatalf("Query with a full queue error = %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	if _, err := New("", WithSynthetic(nil), WithDialTimeout(-time.Second)); err == nil {
+		t.Fatal("New with a negative dial timeout succeeded, want an error")
+	}
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	if p.opts.dialTimeout != defaultDialTimeout {
+		t.Errorf("default dial timeout = %v, want %v", p.opts.dialTimeout, defaultDialTimeout)
+	}
+}
+
+func TestBlockingEnqueue(t *testing.T) {
+	p := newFullQueue(t, 50*time.Millisecond, WithBlockingEnqueue(time.Second))
+	if _, err := p.Query(net.ParseIP("192.0.2.3")); err != nil {
+		t.Fatalf("Query waiting for room in the queue error = %v", err)
+	}
+
+	p = newFullQueue(t, time.Second, WithBlockingEnqueue(10*time.Millisecond))
+	if _, err := p.Query(net.ParseIP("192.0.2.3")); err != ErrQueueFull {
+		t.Fatalf("Query past the enqueue timeout error = %v, want %v", err, ErrQueueFull)
+	}
+	p = newFullQueue(t, time.Second, WithBlockingEnqueue(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.QueryContext(ctx, net.ParseIP("192.0.2.3")); err != context.DeadlineExceeded {
+		t.Fatalf("QueryContext with a full queue and an expired context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{"192.0.2.1": {}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := p.Lookup(net.ParseIP("192.0.2.1")); !found || err != nil {
+		t.Errorf("Lookup of a known address = %t, %v, want true, nil", found, err)
+	}
+	if _, found, err := p.Lookup(net.ParseIP("192.0.2.2")); found || err != nil {
+		t.Errorf("Lookup of an unknown address = %t, %v, want false, nil", found, err)
+	}
+	p.Shutdown()
+	if _, found, err := p.Lookup(net.ParseIP("192.0.2.1")); found || err != ErrShutdown {
+		t.Errorf("Lookup after Shutdown = %t, %v, want false, %v", found, err, ErrShutdown)
+	}
+}
+
+func TestStatsRoundTrips(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+	for range 4 {
+		if _, err := p.Query(net.ParseIP("192.0.2.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := p.Stats().RoundTrips
+	if h.Count != 4 || h.Sum <= 0 || len(h.Buckets) != len(durationBuckets)+1 {
+		t.Fatalf("RoundTrips = %+v, want 4 durations", h)
+	}
+	if q := h.Quantile(0.99); q <= 0 || q > h.Buckets[len(h.Buckets)-1].UpperBound {
+		t.Errorf("Quantile(0.99) = %s", q)
+	}
+
+	h = Histogram{Count: 10, Buckets: []HistogramBucket{{time.Millisecond, 9}, {time.Second, 1}}}
+	if q := h.Quantile(0.5); q != time.Millisecond {
+		t.Errorf("Quantile(0.5) = %s, want 1ms", q)
+	}
+	if q := h.Quantile(0.99); q != time.Second {
+		t.Errorf("Quantile(0.99) = %s, want 1s", q)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	stop := serveSynthetic(t, sockFile)
+	var mu sync.Mutex
+	var dials []time.Time
+	dialer := func() (net.Conn, error) {
+		mu.Lock()
+		dials = append(dials, time.Now())
+		mu.Unlock()
+		return net.Dial("unix", sockFile)
+	}
+	p, err := New("", WithDialer(dialer), WithReconnect(20*time.Millisecond, time.Second),
+		WithReconnectLimit(5, 0), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	ip := net.ParseIP("192.0.2.1")
+	stop()
+	p.Query(ip) // Fails and starts reconnecting
+	// The delays after the first 4 attempts add up to at most 300ms
+	time.Sleep(400 * time.Millisecond)
+
+	mu.Lock()
+	attempts := append([]time.Time(nil), dials[1:]...)
+	mu.Unlock()
+	if len(attempts) != 5 {
+		t.Fatalf("%d reconnect attempts, want 5", len(attempts))
+	}
+	// Jittered, the first delay is 10 to 20ms and the last one 80 to 160ms
+	if first, last := attempts[1].Sub(attempts[0]), attempts[4].Sub(attempts[3]); first < 10*time.Millisecond || last < 80*time.Millisecond {
+		t.Errorf("first delay = %s, last delay = %s, want growing delays", first, last)
+	}
+	if p.IsConnected() {
+		t.Error("IsConnected() = true after giving up reconnecting")
+	}
+
+	// Queries after giving up do not start reconnecting again
+	p.Query(ip)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dials) != 6 {
+		t.Errorf("%d dials after giving up, want 6", len(dials))
+	}
+}
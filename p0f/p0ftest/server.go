@@ -0,0 +1,144 @@
+// Package p0ftest provides a fake p0f API server for testing code built on package p0f
+// without running p0f.
+package p0ftest
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bluemods/p0f-go/p0f"
+)
+
+// Fault is a way of answering a query incorrectly, see NewFaultyServer.
+type Fault int
+
+const (
+	FaultNone       Fault = iota // Answer normally
+	FaultBadQuery                // Answer with a bad query result, as p0f does for malformed queries
+	FaultBadMagic                // Answer with a frame whose magic bytes are wrong
+	FaultShortFrame              // Write part of a frame and close the connection
+	FaultClose                   // Close the connection without answering
+)
+
+// Starts a fake p0f listening on a unix socket in a new temporary directory,
+// and returns the path of the socket to pass to p0f.New, and a function that stops the server
+// and removes the directory. The server speaks the same protocol as p0f, using the codec of package p0f.
+//
+// Queries for an address in responses, keyed by IP address string, are answered with its response,
+// other queries with no match. The Ip, LinkClass and Flags fields of responses are ignored,
+// those are computed by the client. IPv4 and IPv4-mapped IPv6 keys are equivalent.
+func NewServer(responses map[string]p0f.P0fResponse) (socketPath string, close func()) {
+	return NewFaultyServer(responses, nil)
+}
+
+// Same as NewServer, answering queries for an address in faults, keyed by IP address string,
+// with its Fault, to test how errors are handled.
+func NewFaultyServer(responses map[string]p0f.P0fResponse, faults map[string]Fault) (socketPath string, close func()) {
+	dir, err := os.MkdirTemp("", "p0ftest")
+	if err != nil {
+		panic("p0ftest: " + err.Error())
+	}
+	socketPath = filepath.Join(dir, "p0f.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic("p0ftest: " + err.Error())
+	}
+
+	s := &server{responses: normalize(responses), faults: normalize(faults), conns: make(map[net.Conn]struct{})}
+	go s.serve(l)
+	var once sync.Once
+	return socketPath, func() {
+		once.Do(func() {
+			l.Close()
+			s.closeConns()
+			os.RemoveAll(dir)
+		})
+	}
+}
+
+type server struct {
+	responses map[string]p0f.P0fResponse
+	faults    map[string]Fault
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Returns m with its keys parsed and formatted as IP addresses, panicking if one is not an IP address.
+func normalize[V any](m map[string]V) map[string]V {
+	normalized := make(map[string]V, len(m))
+	for key, v := range m {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			panic("p0ftest: " + key + " is not an IP address")
+		}
+		normalized[ip.String()] = v
+	}
+	return normalized
+}
+
+func (s *server) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	buffer := make([]byte, p0f.RequestSize)
+	for {
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return
+		}
+		ip, err := p0f.DecodeRequest(buffer)
+		if err != nil {
+			conn.Write(p0f.EncodeResponse(p0f.P0fResponse{}, p0f.ErrBadQuery))
+			continue
+		}
+
+		response, ok := s.responses[ip.String()]
+		frame := p0f.EncodeResponse(response, nil)
+		if !ok {
+			frame = p0f.EncodeResponse(response, p0f.ErrNoMatch)
+		}
+		switch s.faults[ip.String()] {
+		case FaultBadQuery:
+			frame = p0f.EncodeResponse(p0f.P0fResponse{}, p0f.ErrBadQuery)
+		case FaultBadMagic:
+			frame[0] ^= 0xff
+		case FaultShortFrame:
+			conn.Write(frame[:len(frame)/2])
+			return
+		case FaultClose:
+			return
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
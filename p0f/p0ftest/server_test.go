@@ -0,0 +1,41 @@
+package p0ftest
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/bluemods/p0f-go/p0f"
+)
+
+func TestServer(t *testing.T) {
+	osName := "Linux"
+	socketPath, closeServer := NewFaultyServer(
+		map[string]p0f.P0fResponse{"192.0.2.1": {OsName: &osName, LinkMtu: 1500}},
+		map[string]Fault{"192.0.2.2": FaultBadQuery, "192.0.2.3": FaultBadMagic},
+	)
+	defer closeServer()
+	client, err := p0f.New(socketPath, p0f.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	response, err := client.Query(net.ParseIP("::ffff:192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.OsName == nil || *response.OsName != osName || response.LinkMtu != 1500 {
+		t.Fatalf("response = %+v, want the canned one", response)
+	}
+	for ip, want := range map[string]error{"198.51.100.1": p0f.ErrNoMatch, "192.0.2.2": p0f.ErrBadQuery} {
+		if _, err := client.QueryString(ip); !errors.Is(err, want) {
+			t.Errorf("QueryString(%s) error = %v, want %v", ip, err, want)
+		}
+	}
+	if _, err := client.QueryString("192.0.2.3"); err == nil {
+		t.Error("QueryString with a bad magic answer succeeded, want an error")
+	}
+}
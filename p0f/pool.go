@@ -0,0 +1,105 @@
+package p0f
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// Returned by Pool queries for IP addresses no member of the pool is responsible for.
+var ErrNoBackend = errors.New("no p0f instance for IP address")
+
+// Pool dispatches queries to one of several P0f instances, such as one per capture interface
+// when p0f runs on each. Create one with NewPool or NewSubnetPool.
+type Pool struct {
+	route   func(ip net.IP) *P0f
+	members []*P0f
+}
+
+// Creates a Pool querying the member returned by route for each IP address.
+// route returns nil for addresses no member is responsible for, which fail with ErrNoBackend.
+// members are the instances route may return, they are shut down by Shutdown.
+func NewPool(route func(ip net.IP) *P0f, members ...*P0f) (*Pool, error) {
+	if route == nil {
+		return nil, errors.New("route must not be nil")
+	}
+	if len(members) == 0 {
+		return nil, errors.New("pool must have at least one member")
+	}
+	pool := &Pool{route: route}
+	for _, p := range members {
+		if p == nil {
+			return nil, errors.New("pool members must not be nil")
+		}
+		if !slices.Contains(pool.members, p) {
+			pool.members = append(pool.members, p)
+		}
+	}
+	return pool, nil
+}
+
+// Creates a Pool querying, for each IP address, the member of the most specific subnet containing it.
+// subnets maps CIDR prefixes (example: "192.0.2.0/24") to members, "0.0.0.0/0" and "::/0"
+// catch the remaining addresses. Addresses outside every subnet fail with ErrNoBackend.
+func NewSubnetPool(subnets map[string]*P0f) (*Pool, error) {
+	type subnet struct {
+		prefix netip.Prefix
+		p      *P0f
+	}
+	routes := make([]subnet, 0, len(subnets))
+	members := make([]*P0f, 0, len(subnets))
+	for cidr, p := range subnets {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet: %w", err)
+		}
+		routes = append(routes, subnet{prefix.Masked(), p})
+		members = append(members, p)
+	}
+	// Most specific first
+	slices.SortFunc(routes, func(a, b subnet) int { return cmp.Compare(b.prefix.Bits(), a.prefix.Bits()) })
+	return NewPool(func(ip net.IP) *P0f {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return nil
+		}
+		addr = addr.Unmap()
+		for _, route := range routes {
+			if route.prefix.Contains(addr) {
+				return route.p
+			}
+		}
+		return nil
+	}, members...)
+}
+
+// Returns the member responsible for ip, nil if there is none.
+// This gives access to the P0f methods Pool does not have.
+func (pool *Pool) Backend(ip net.IP) *P0f {
+	return pool.route(ip)
+}
+
+// Queries the member responsible for ip, see P0f.Query.
+func (pool *Pool) Query(ip net.IP) (P0fResponse, error) {
+	return pool.QueryContext(context.Background(), ip)
+}
+
+// Queries the member responsible for ip, see P0f.QueryContext.
+func (pool *Pool) QueryContext(ctx context.Context, ip net.IP) (P0fResponse, error) {
+	p := pool.route(ip)
+	if p == nil {
+		return P0fResponse{}, fmt.Errorf("%w: %s", ErrNoBackend, ip)
+	}
+	return p.QueryContext(ctx, ip)
+}
+
+// Shuts down every member of the pool, see P0f.Shutdown.
+func (pool *Pool) Shutdown() {
+	for _, p := range pool.members {
+		p.Shutdown()
+	}
+}
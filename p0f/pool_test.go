@@ -0,0 +1,51 @@
+package p0f
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSubnetPool(t *testing.T) {
+	newMember := func(ip, osName string) *P0f {
+		p, err := New("", WithSynthetic(map[string]P0fResponse{ip: {OsName: syntheticString(osName)}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	lan := newMember("192.0.2.1", "Linux")
+	host := newMember("192.0.2.2", "Windows")
+	wan := newMember("2001:db8::1", "Mac OS X")
+	pool, err := NewSubnetPool(map[string]*P0f{
+		"192.0.2.0/24":  lan,
+		"192.0.2.2/32":  host,
+		"2001:db8::/32": wan,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]string{"192.0.2.1": "Linux", "192.0.2.2": "Windows", "2001:db8::1": "Mac OS X"} {
+		response, err := pool.Query(net.ParseIP(ip))
+		if err != nil {
+			t.Fatalf("Query(%s) error = %v", ip, err)
+		}
+		if *response.OsName != want {
+			t.Errorf("Query(%s) OsName = %q, want %q", ip, *response.OsName, want)
+		}
+	}
+	if _, err := pool.Query(net.ParseIP("198.51.100.1")); !errors.Is(err, ErrNoBackend) {
+		t.Errorf("Query outside every subnet error = %v, want %v", err, ErrNoBackend)
+	}
+	if _, err := NewSubnetPool(map[string]*P0f{"192.0.2.0": lan}); err == nil {
+		t.Error("NewSubnetPool with an invalid subnet succeeded, want an error")
+	}
+
+	pool.Shutdown()
+	for _, p := range []*P0f{lan, host, wan} {
+		if _, err := p.Query(net.ParseIP("192.0.2.1")); err != ErrShutdown {
+			t.Errorf("Query of a member after Pool.Shutdown error = %v, want %v", err, ErrShutdown)
+		}
+	}
+}
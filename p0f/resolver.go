@@ -0,0 +1,117 @@
+package p0f
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type connContextKey struct{}
+
+// ConnContext stores the connection of each request in its context,
+// which resolvers made with ConnResolver need.
+// It is installed by ServeHttp. When serving with your own http.Server,
+// set its ConnContext field to this function.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// Returns the connection stored by ConnContext, if any.
+func ConnFromContext(ctx context.Context) (net.Conn, bool) {
+	c, ok := ctx.Value(connContextKey{}).(net.Conn)
+	return c, ok
+}
+
+// Returns an ipResolver that derives the address to query from the request's connection
+// using addr, which must return a "host:port" address.
+// If the connection is not available or addr fails, r.RemoteAddr is used instead.
+//
+// Connections redirected to this server by netfilter (iptables REDIRECT or DNAT) keep their
+// source address, so r.RemoteAddr already is the client then, and DefaultIpResolver is enough.
+// OriginalDst is the address the client connected to, this server's before the redirect,
+// so it must not be used as the address to query.
+func ConnResolver(addr func(c net.Conn) (string, error)) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if c, ok := ConnFromContext(r.Context()); ok {
+			if s, err := addr(unwrapConn(c)); err == nil {
+				return s
+			}
+		}
+		return r.RemoteAddr
+	}
+}
+
+// Returns the underlying connection of TLS and similar wrappers.
+func unwrapConn(c net.Conn) net.Conn {
+	for {
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = w.NetConn()
+	}
+}
+
+// Returns an ipResolver for servers behind reverse proxies that set X-Forwarded-For.
+//
+// If r.RemoteAddr is within one of the trusted networks, the X-Forwarded-For chain
+// is walked from right to left, skipping addresses within the trusted networks,
+// and the first untrusted address is returned. Otherwise, r.RemoteAddr is returned
+// and the header is ignored, as anyone can set it. If every address in the chain
+// is trusted, the leftmost one is returned.
+//
+// If the chain has an entry that is not an IP address before an untrusted one is found,
+// r.RemoteAddr is returned, as the addresses left of it cannot be relied on.
+//
+// p0f must see the traffic of the returned address for queries to match,
+// so this is only useful when p0f runs where client connections arrive,
+// such as on the proxy host itself.
+func ForwardedForResolver(trusted []net.IPNet) func(r *http.Request) string {
+	isTrusted := func(ip net.IP) bool { return inNetworks(ip, trusted) }
+	return func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		if remote := net.ParseIP(host); remote == nil || !isTrusted(remote) {
+			return r.RemoteAddr
+		}
+
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		var leftmost net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseForwardedHop(hops[i])
+			if ip == nil {
+				return r.RemoteAddr
+			}
+			if !isTrusted(ip) {
+				return net.JoinHostPort(ip.String(), "0")
+			}
+			leftmost = ip
+		}
+		if leftmost == nil {
+			return r.RemoteAddr
+		}
+		return net.JoinHostPort(leftmost.String(), "0")
+	}
+}
+
+// Parses an X-Forwarded-For entry, which some proxies write with a port
+// ("192.0.2.1:1234", "[2001:db8::1]:1234") or with brackets but no port ("[2001:db8::1]").
+func parseForwardedHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(hop, "[") && strings.HasSuffix(hop, "]") {
+		return net.ParseIP(hop[1 : len(hop)-1])
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package p0f
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// Returns the "host:port" the client originally connected to before netfilter redirected the connection,
+// such as for logging which service a redirected client asked for.
+// This is an address of this host before the redirect, not the client, see ConnResolver.
+func OriginalDst(c net.Conn) (addr string, err error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return "", errors.New("connection has no file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	local, _ := c.LocalAddr().(*net.TCPAddr)
+	if local == nil {
+		return "", errors.New("not a TCP connection")
+	}
+
+	// The syscall package has no getsockopt returning a raw sockaddr, and calling getsockopt
+	// directly is not portable across architectures (linux/386 goes through socketcall).
+	// The option is read with the getsockopt of a struct of the right size instead,
+	// whose bytes are then decoded as the sockaddr the kernel wrote to them.
+	var opErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// struct sockaddr_in (16 bytes) is written over Multiaddr of an ipv6_mreq (20 bytes)
+			var mreq *syscall.IPv6Mreq
+			if mreq, opErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); opErr == nil {
+				addr, opErr = decodeSockaddrInet4(mreq.Multiaddr)
+			}
+		} else {
+			// struct sockaddr_in6 is the first member of ip6_mtuinfo, the rest is left untouched
+			var info *syscall.IPv6MTUInfo
+			if info, opErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); opErr == nil {
+				addr, opErr = decodeSockaddrInet6(info.Addr)
+			}
+		}
+	})
+	if err == nil {
+		err = opErr
+	}
+	return
+}
+
+// Decodes the bytes of a struct sockaddr_in: the native endian family,
+// then the port and address in network byte order.
+func decodeSockaddrInet4(sa [16]byte) (string, error) {
+	if family := binary.NativeEndian.Uint16(sa[0:2]); family != syscall.AF_INET {
+		return "", fmt.Errorf("unexpected address family %d", family)
+	}
+	port := binary.BigEndian.Uint16(sa[2:4])
+	return net.JoinHostPort(net.IP(sa[4:8]).String(), strconv.Itoa(int(port))), nil
+}
+
+// Decodes a struct sockaddr_in6. Its Port holds the port in network byte order,
+// read as a native endian integer.
+func decodeSockaddrInet6(sa syscall.RawSockaddrInet6) (string, error) {
+	if sa.Family != syscall.AF_INET6 {
+		return "", fmt.Errorf("unexpected address family %d", sa.Family)
+	}
+	var port [2]byte
+	binary.NativeEndian.PutUint16(port[:], sa.Port)
+	return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package p0f
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestDecodeSockaddr(t *testing.T) {
+	var sa4 [16]byte
+	binary.NativeEndian.PutUint16(sa4[0:2], syscall.AF_INET)
+	binary.BigEndian.PutUint16(sa4[2:4], 8080)
+	copy(sa4[4:8], net.ParseIP("192.0.2.1").To4())
+	if addr, err := decodeSockaddrInet4(sa4); err != nil || addr != "192.0.2.1:8080" {
+		t.Errorf("decodeSockaddrInet4 = %q, %v, want 192.0.2.1:8080", addr, err)
+	}
+	binary.NativeEndian.PutUint16(sa4[0:2], syscall.AF_INET6)
+	if _, err := decodeSockaddrInet4(sa4); err == nil {
+		t.Error("decodeSockaddrInet4 of an AF_INET6 address succeeded")
+	}
+
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], 443)
+	sa6 := syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Port: binary.NativeEndian.Uint16(port[:])}
+	copy(sa6.Addr[:], net.ParseIP("2001:db8::1"))
+	if addr, err := decodeSockaddrInet6(sa6); err != nil || addr != "[2001:db8::1]:443" {
+		t.Errorf("decodeSockaddrInet6 = %q, %v, want [2001:db8::1]:443", addr, err)
+	}
+	sa6.Family = syscall.AF_INET
+	if _, err := decodeSockaddrInet6(sa6); err == nil {
+		t.Error("decodeSockaddrInet6 of an AF_INET address succeeded")
+	}
+}
+
+// Without a netfilter redirect, the kernel has no original destination to report.
+func TestOriginalDstNotRedirected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr, err := OriginalDst(c); err == nil {
+		t.Errorf("OriginalDst of a connection that was not redirected = %q, want an error", addr)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package p0f
+
+import (
+	"errors"
+	"net"
+)
+
+// Returns the "host:port" the client originally connected to before netfilter redirected the connection.
+// Only supported on Linux.
+func OriginalDst(c net.Conn) (string, error) {
+	return "", errors.New("SO_ORIGINAL_DST is only supported on Linux")
+}
@@ -0,0 +1,46 @@
+package p0f
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedForResolver(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	_, proxies6, _ := net.ParseCIDR("fd00::/8")
+	resolve := ForwardedForResolver([]net.IPNet{*proxies, *proxies6})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"untrusted remote", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1:1234"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"single hop", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"spoofed left of client", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1:0"},
+		{"multiple headers", "10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.1"}, "198.51.100.1:0"},
+		{"IPv6", "[fd00::1]:1234", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"IPv6 with port", "[fd00::1]:1234", []string{"[2001:db8::1]:443"}, "[2001:db8::1]:0"},
+		{"IPv6 in brackets", "10.0.0.1:1234", []string{"[2001:db8::1]"}, "[2001:db8::1]:0"},
+		{"IPv4 with port", "10.0.0.1:1234", []string{"198.51.100.1:443"}, "198.51.100.1:0"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:0"},
+		{"malformed", "10.0.0.1:1234", []string{"198.51.100.1, unknown"}, "10.0.0.1:1234"},
+		{"empty entry", "10.0.0.1:1234", []string{"198.51.100.1,,"}, "10.0.0.1:1234"},
+		{"malformed remote", "garbage", []string{"198.51.100.1"}, "garbage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := resolve(r); got != tt.want {
+				t.Errorf("resolve = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package p0f
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Risk indicators reported in P0fResponse.Flags.
+const (
+	FlagBadSoftware     = "bad_software"      // BadSw is set: the User-Agent or Server header contradicts the detected OS
+	FlagLowMatchQuality = "low_match_quality" // OsMatchQ reports a fuzzy or generic OS signature match
+	FlagNAT             = "nat"               // LastNat is set: NAT or load balancing was detected for this host
+	FlagLikelyVPN       = "likely_vpn"        // LinkClass is LinkTunnel
+	FlagOSChanged       = "os_changed"        // LastChg is within recentChangeWindow of LastSeen
+)
+
+// How close to LastSeen an OS change must be to be reported as FlagOSChanged.
+const recentChangeWindow = 24 * time.Hour
+
+// LinkClass is a coarse classification of the free-form p0f LinkType.
+type LinkClass string
+
+const (
+	LinkEthernet LinkClass = "ethernet" // Ethernet, VLAN, or a plain modem
+	LinkDSL      LinkClass = "dsl"      // DSL and PPPoE
+	LinkTunnel   LinkClass = "tunnel"   // VPNs and tunnels (GRE, IPSec, IPIP, PPTP, ...)
+	LinkWifi     LinkClass = "wifi"     // Wireless LAN
+	LinkUnknown  LinkClass = "unknown"  // No link type, or one that is not recognized
+)
+
+// Words identifying each class in a p0f link type, checked in order.
+// Tunnels come first as their labels may also name the carrier, e.g. "Ethernet over GRE".
+var linkClassWords = []struct {
+	class LinkClass
+	words []string
+}{
+	{LinkTunnel, []string{"tunnel", "vpn", "openvpn", "wireguard", "ipsec", "gre", "ipip", "sit", "gif", "pptp", "l2tp", "6to4", "teredo"}},
+	{LinkWifi, []string{"wifi", "wi-fi", "wlan", "wireless", "802.11"}},
+	{LinkDSL, []string{"dsl", "adsl", "vdsl", "pppoe"}},
+	{LinkEthernet, []string{"ethernet", "vlan", "modem"}},
+}
+
+// Maps a p0f link type such as "Ethernet or modem" or "generic tunnel or VPN" to its LinkClass.
+func classifyLinkType(linkType *string) LinkClass {
+	if linkType == nil {
+		return LinkUnknown
+	}
+	words := strings.FieldsFunc(strings.ToLower(*linkType), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '.'
+	})
+	for _, c := range linkClassWords {
+		for _, w := range words {
+			for _, known := range c.words {
+				if w == known {
+					return c.class
+				}
+			}
+		}
+	}
+	return LinkUnknown
+}
+
+// Collects the risk indicators of r, in the order the Flag constants are declared.
+// Never returns nil, so the JSON output is always an array.
+func computeFlags(r P0fResponse) []string {
+	flags := []string{}
+	if r.BadSw != 0 {
+		flags = append(flags, FlagBadSoftware)
+	}
+	if r.OsMatchQ&(matchFuzzy|matchGeneric) != 0 {
+		flags = append(flags, FlagLowMatchQuality)
+	}
+	if r.IsNAT() {
+		flags = append(flags, FlagNAT)
+	}
+	if r.LinkClass == LinkTunnel {
+		flags = append(flags, FlagLikelyVPN)
+	}
+	if r.LastChg != 0 && r.LastSeen >= r.LastChg && time.Duration(r.LastSeen-r.LastChg)*time.Second <= recentChangeWindow {
+		flags = append(flags, FlagOSChanged)
+	}
+	return flags
+}
+
+// Replaces each string field of r by its sanitized value.
+func sanitizeResponse(r *P0fResponse, sanitize func(string) string) {
+	for _, field := range []**string{&r.OsName, &r.OsFlavor, &r.HttpName, &r.HttpFlavor, &r.LinkType, &r.Language} {
+		if *field == nil {
+			continue
+		}
+		if s := sanitize(**field); s != "" {
+			*field = &s
+		} else {
+			*field = nil
+		}
+	}
+}
+
+// Coarse device types returned by DeviceType
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceServer  = "server"
+	DeviceIoT     = "iot"
+	DeviceUnknown = "unknown"
+)
+
+// OS name prefixes with the device type they (almost) always run on.
+// Checked in order, so longer prefixes must precede shorter ones they start with.
+var deviceOsPrefixes = []struct {
+	prefix     string
+	deviceType string
+}{
+	{"windows phone", DeviceMobile},
+	{"windows mobile", DeviceMobile},
+	{"android", DeviceMobile},
+	{"ios", DeviceMobile},
+	{"iphone", DeviceMobile},
+	{"blackberry", DeviceMobile},
+	{"symbian", DeviceMobile},
+	{"windows", DeviceDesktop},
+	{"mac os", DeviceDesktop},
+	{"macos", DeviceDesktop},
+	{"freebsd", DeviceServer},
+	{"openbsd", DeviceServer},
+	{"netbsd", DeviceServer},
+	{"solaris", DeviceServer},
+	{"hp-ux", DeviceServer},
+	{"aix", DeviceServer},
+	{"openvms", DeviceServer},
+	{"nintendo", DeviceIoT},
+	{"playstation", DeviceIoT},
+	{"xbox", DeviceIoT},
+}
+
+// Same as DeviceTypeGuess, without the confidence.
+func (r P0fResponse) DeviceType() string {
+	deviceType, _ := r.DeviceTypeGuess()
+	return deviceType
+}
+
+// Guesses the kind of device from the OS, link type and MTU reported by p0f.
+// confident is false for guesses based on weak hints, which should be treated as such.
+//
+// The heuristic is:
+//   - OS names only found on one kind of device (Android, iOS, Windows, Mac OS, the BSDs, consoles, ...)
+//     map to that device type.
+//   - Linux is ambiguous: embedded or barebone flavors suggest IoT, a detected HTTP client
+//     (browser) suggests a desktop, a jumbo frame MTU suggests a server, and anything else
+//     is assumed to be a server with low confidence.
+//   - Fuzzy or generic OS matches, and hosts behind a tunnel (whose fingerprint may be
+//     that of the VPN endpoint) are never confident.
+//   - Without an OS name, DeviceUnknown is returned.
+func (r P0fResponse) DeviceTypeGuess() (deviceType string, confident bool) {
+	if r.OsName == nil {
+		return DeviceUnknown, false
+	}
+	deviceType, confident = DeviceUnknown, false
+
+	osName := strings.ToLower(*r.OsName)
+	for _, d := range deviceOsPrefixes {
+		if strings.HasPrefix(osName, d.prefix) {
+			deviceType, confident = d.deviceType, true
+			break
+		}
+	}
+	if strings.HasPrefix(osName, "linux") {
+		flavor := ""
+		if r.OsFlavor != nil {
+			flavor = strings.ToLower(*r.OsFlavor)
+		}
+		switch {
+		case strings.Contains(flavor, "embedded"), strings.Contains(flavor, "barebone"):
+			deviceType = DeviceIoT
+		case r.HttpName != nil:
+			deviceType = DeviceDesktop
+		case r.LinkMtu > 1500:
+			deviceType, confident = DeviceServer, true
+		default:
+			deviceType = DeviceServer
+		}
+	}
+
+	if r.OsMatchQ&(matchFuzzy|matchGeneric) != 0 || r.LinkClass == LinkTunnel {
+		confident = false
+	}
+	return
+}
+
+// MatchQuality ranks how well the OS signature of a host matched, from worst to best.
+type MatchQuality int
+
+const (
+	MatchNone         MatchQuality = iota // No OS was detected
+	MatchFuzzyGeneric                     // Approximate match against a generic signature
+	MatchFuzzy                            // Approximate match against a specific signature
+	MatchGeneric                          // Exact match against a generic signature
+	MatchExact                            // Exact match against a specific signature
+)
+
+// Ranks the OS match, based on OsName and the fuzzy and generic bits of OsMatchQ.
+func (r P0fResponse) MatchQuality() MatchQuality {
+	if r.OsName == nil {
+		return MatchNone
+	}
+	switch r.OsMatchQ & (matchFuzzy | matchGeneric) {
+	case matchFuzzy | matchGeneric:
+		return MatchFuzzyGeneric
+	case matchFuzzy:
+		return MatchFuzzy
+	case matchGeneric:
+		return MatchGeneric
+	default:
+		return MatchExact
+	}
+}
+
+// Returns an identifier of the host's fingerprint, a hex encoded hash of the fields that
+// describe the host itself: the OS and its match quality, HTTP application, link type, MTU, distance and language.
+// Counters and timestamps are left out, so the identifier stays the same across queries
+// for as long as p0f sees the same host configuration.
+//
+// Different hosts with identical configurations share an identifier,
+// so this correlates devices within a session rather than identifying them.
+func (r P0fResponse) Fingerprint() string {
+	h := sha256.New()
+	for _, field := range []*string{r.OsName, r.OsFlavor, r.HttpName, r.HttpFlavor, r.LinkType, r.Language} {
+		if field != nil {
+			h.Write([]byte(*field))
+		}
+		h.Write([]byte{0})
+	}
+	var numbers [5]byte
+	binary.BigEndian.PutUint16(numbers[0:2], r.LinkMtu)
+	binary.BigEndian.PutUint16(numbers[2:4], r.Distance)
+	numbers[4] = r.OsMatchQ
+	h.Write(numbers[:])
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Returns FirstSeen, when p0f first saw the host, as a time.Time.
+func (r P0fResponse) FirstSeenTime() time.Time {
+	return time.Unix(int64(r.FirstSeen), 0)
+}
+
+// Returns LastSeen, when p0f last saw the host, as a time.Time.
+func (r P0fResponse) LastSeenTime() time.Time {
+	return time.Unix(int64(r.LastSeen), 0)
+}
+
+// Returns LastNat, when NAT or load balancing was last detected for the host,
+// or nil if it never was.
+func (r P0fResponse) LastNatTime() *time.Time {
+	return optionalTime(r.LastNat)
+}
+
+// Returns LastChg, when the OS of the host was last seen changing,
+// or nil if it never was.
+func (r P0fResponse) LastChgTime() *time.Time {
+	return optionalTime(r.LastChg)
+}
+
+// Reports whether p0f has ever detected NAT or load balancing for the host, that is
+// whether LastNat is set. p0f sets LastNat when packets from the address carry
+// inconsistent signals (TTL, MTU, uptime or OS) that suggest several hosts behind it,
+// and never clears it, so this stays true once it is.
+func (r P0fResponse) IsNAT() bool {
+	return r.LastNat != 0
+}
+
+// Reports whether the host appears to have changed since t, that is whether LastChg is after t.
+// p0f sets LastChg when the fingerprint of an address changes, such as when the host
+// rebooted into another OS, or another host took over the address.
+//
+// p0f does not report reboots into the same OS, and UptimeMin cannot reliably date them
+// as it wraps around every UpModDays, so those are not detected.
+func (r P0fResponse) RebootedSince(t time.Time) bool {
+	return r.LastChg != 0 && time.Unix(int64(r.LastChg), 0).After(t)
+}
+
+// Returns UptimeMin, the uptime of the host computed by p0f from its TCP timestamps, as a duration.
+// ok is false if p0f has no uptime for the host, which it reports as both UptimeMin and UpModDays being 0.
+//
+// The TCP timestamp clock wraps around every UpModDays days, so the actual uptime
+// may be longer by a multiple of that.
+func (r P0fResponse) Uptime() (uptime time.Duration, ok bool) {
+	if r.UptimeMin == 0 && r.UpModDays == 0 {
+		return 0, false
+	}
+	return time.Duration(r.UptimeMin) * time.Minute, true
+}
+
+// Formats Uptime as days, hours and minutes such as "3d 4h 12m", leaving out leading zero units.
+// Returns the empty string if p0f has no uptime for the host.
+func (r P0fResponse) UptimeString() string {
+	uptime, ok := r.Uptime()
+	if !ok {
+		return ""
+	}
+	minutes := int64(uptime / time.Minute)
+	days, hours := minutes/(24*60), minutes/60%24
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes%60)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes%60)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// Converts unix seconds to a time.Time, where 0 means never.
+func optionalTime(unix uint32) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(int64(unix), 0)
+	return &t
+}
+
+// OSFamily is a coarse classification of the free-form p0f OsName.
+type OSFamily string
+
+const (
+	OSWindows OSFamily = "windows"
+	OSLinux   OSFamily = "linux"
+	OSAndroid OSFamily = "android"
+	OSMac     OSFamily = "mac"
+	OSIOS     OSFamily = "ios"
+	OSBSD     OSFamily = "bsd"     // FreeBSD, OpenBSD, NetBSD and DragonFly
+	OSUnknown OSFamily = "unknown" // No OS name, or one that is not recognized
+)
+
+// OS name prefixes with the family they belong to, matched case-insensitively.
+// Checked in order, so longer prefixes must precede shorter ones they start with.
+var osFamilyPrefixes = []struct {
+	prefix string
+	family OSFamily
+}{
+	{"windows", OSWindows},
+	{"android", OSAndroid},
+	{"linux", OSLinux},
+	{"mac os", OSMac},
+	{"macos", OSMac},
+	{"ios", OSIOS},
+	{"iphone", OSIOS},
+	{"freebsd", OSBSD},
+	{"openbsd", OSBSD},
+	{"netbsd", OSBSD},
+	{"dragonfly", OSBSD},
+}
+
+// Classifies OsName, such as "Windows", "Linux" or "Mac OS X", into its OSFamily.
+// OSUnknown is returned without an OS name.
+func (r P0fResponse) OSFamily() OSFamily {
+	if r.OsName == nil {
+		return OSUnknown
+	}
+	osName := strings.ToLower(*r.OsName)
+	for _, f := range osFamilyPrefixes {
+		if strings.HasPrefix(osName, f.prefix) {
+			return f.family
+		}
+	}
+	return OSUnknown
+}
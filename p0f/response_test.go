@@ -0,0 +1,159 @@
+package p0f
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClassifyLinkType(t *testing.T) {
+	for _, test := range []struct {
+		linkType string // "" for no link type
+		want     LinkClass
+	}{
+		{"", LinkUnknown},
+		{"Ethernet or modem", LinkEthernet},
+		{"VLAN", LinkEthernet},
+		{"DSL", LinkDSL},
+		{"PPPoE", LinkDSL},
+		{"generic tunnel or VPN", LinkTunnel},
+		{"IPSec or GRE", LinkTunnel},
+		{"IPIP or SIT", LinkTunnel},
+		{"OpenVPN UDP IPv4", LinkTunnel},
+		{"wireless", LinkWifi},
+		{"loopback", LinkUnknown},
+		{"???", LinkUnknown},
+	} {
+		var linkType *string
+		if test.linkType != "" {
+			linkType = &test.linkType
+		}
+		if got := classifyLinkType(linkType); got != test.want {
+			t.Errorf("classifyLinkType(%q) = %q, want %q", test.linkType, got, test.want)
+		}
+	}
+}
+
+func TestQuerySanitizer(t *testing.T) {
+	raw := rawResponse{Magic: magicBytesRcv, Status: resultOk}
+	copy(raw.OsName[:], "Linux")
+	copy(raw.LinkType[:], "generic tunnel or VPN")
+	sockFile := filepath.Join(t.TempDir(), "p0f.sock")
+	serveResponses(t, sockFile, nil, func(net.IP) []byte { return encodeRaw(t, raw) })
+	sanitize := func(s string) string {
+		if s == "generic tunnel or VPN" {
+			return "Ethernet or modem"
+		}
+		return ""
+	}
+	p, err := New(sockFile, WithSanitizer(sanitize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	r, err := p.Query(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OsName != nil {
+		t.Errorf("OsName = %q, want nil", *r.OsName)
+	}
+	if r.LinkType == nil || *r.LinkType != "Ethernet or modem" {
+		t.Errorf("LinkType = %v, want Ethernet or modem", r.LinkType)
+	}
+	if r.LinkClass != LinkEthernet {
+		t.Errorf("LinkClass = %q, want %q", r.LinkClass, LinkEthernet)
+	}
+	for _, flag := range r.Flags {
+		if flag == FlagLikelyVPN {
+			t.Errorf("Flags = %v, want no %s after sanitizing the link type", r.Flags, FlagLikelyVPN)
+		}
+	}
+}
+
+func TestDeviceTypeGuess(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		r             P0fResponse
+		want          string
+		wantConfident bool
+	}{
+		{"no OS", P0fResponse{}, DeviceUnknown, false},
+		{"Android", P0fResponse{OsName: syntheticString("Android")}, DeviceMobile, true},
+		{"iOS", P0fResponse{OsName: syntheticString("iOS")}, DeviceMobile, true},
+		{"Windows", P0fResponse{OsName: syntheticString("Windows")}, DeviceDesktop, true},
+		{"Mac OS X", P0fResponse{OsName: syntheticString("Mac OS X")}, DeviceDesktop, true},
+		{"FreeBSD", P0fResponse{OsName: syntheticString("FreeBSD")}, DeviceServer, true},
+		{"Nintendo", P0fResponse{OsName: syntheticString("Nintendo 3DS")}, DeviceIoT, true},
+		{"unknown OS", P0fResponse{OsName: syntheticString("Plan 9")}, DeviceUnknown, false},
+		{"embedded Linux", P0fResponse{OsName: syntheticString("Linux"), OsFlavor: syntheticString("(Embedded)")}, DeviceIoT, false},
+		{"Linux browser", P0fResponse{OsName: syntheticString("Linux"), HttpName: syntheticString("Firefox")}, DeviceDesktop, false},
+		{"Linux jumbo frames", P0fResponse{OsName: syntheticString("Linux"), LinkMtu: 9000}, DeviceServer, true},
+		{"Linux", P0fResponse{OsName: syntheticString("Linux"), LinkMtu: 1500}, DeviceServer, false},
+		{"fuzzy match", P0fResponse{OsName: syntheticString("Windows"), OsMatchQ: matchFuzzy}, DeviceDesktop, false},
+		{"generic match", P0fResponse{OsName: syntheticString("Windows"), OsMatchQ: matchGeneric}, DeviceDesktop, false},
+		{"tunnel", P0fResponse{OsName: syntheticString("Android"), LinkClass: LinkTunnel}, DeviceMobile, false},
+	} {
+		deviceType, confident := test.r.DeviceTypeGuess()
+		if deviceType != test.want || confident != test.wantConfident {
+			t.Errorf("DeviceTypeGuess() for %s = %q, %v, want %q, %v", test.name, deviceType, confident, test.want, test.wantConfident)
+		}
+	}
+}
+
+func TestOSFamily(t *testing.T) {
+	for _, test := range []struct {
+		osName string // "" for no OS name
+		want   OSFamily
+	}{
+		{"", OSUnknown},
+		{"Windows", OSWindows},
+		{"Linux", OSLinux},
+		{"Android", OSAndroid},
+		{"Mac OS X", OSMac},
+		{"iOS", OSIOS},
+		{"FreeBSD", OSBSD},
+		{"OpenBSD", OSBSD},
+		{"Solaris", OSUnknown},
+	} {
+		r := P0fResponse{OsName: syntheticString(test.osName)}
+		if got := r.OSFamily(); got != test.want {
+			t.Errorf("OSFamily() for %q = %q, want %q", test.osName, got, test.want)
+		}
+	}
+}
+
+func TestRebootedSince(t *testing.T) {
+	changed := time.Unix(1700000000, 0)
+	r := P0fResponse{LastChg: uint32(changed.Unix())}
+	if !r.RebootedSince(changed.Add(-time.Minute)) {
+		t.Error("RebootedSince a minute before LastChg = false, want true")
+	}
+	if r.RebootedSince(changed) {
+		t.Error("RebootedSince LastChg = true, want false")
+	}
+	if (P0fResponse{}).RebootedSince(time.Time{}) {
+		t.Error("RebootedSince without LastChg = true, want false")
+	}
+}
+
+func TestUptimeString(t *testing.T) {
+	for _, test := range []struct {
+		uptimeMin, upModDays uint32
+		want                 string
+	}{
+		{0, 0, ""},
+		{0, 49, "0m"},
+		{12, 49, "12m"},
+		{4*60 + 12, 49, "4h 12m"},
+		{3*24*60 + 4*60 + 12, 49, "3d 4h 12m"},
+		{3 * 24 * 60, 49, "3d 0h 0m"},
+	} {
+		r := P0fResponse{UptimeMin: test.uptimeMin, UpModDays: test.upModDays}
+		if got := r.UptimeString(); got != test.want {
+			t.Errorf("UptimeString() for %d minutes = %q, want %q", test.uptimeMin, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package p0f
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	maxTempRetries = 3                    // Retries of a read or write failing with a temporary error
+	tempRetryDelay = 5 * time.Millisecond // Delay before the first retry, doubled for each following one
+)
+
+// Retries reads and writes of the wrapped connection that fail with a temporary error,
+// such as EINTR or EAGAIN, up to maxTempRetries times.
+// Only once the retries are exhausted, or allow denies one, is the error returned,
+// and the connection considered broken.
+type retryConn struct {
+	net.Conn
+	allow func() bool // Called before each retry, see P0f.allowRetry
+}
+
+func (c retryConn) Read(b []byte) (n int, err error) {
+	for attempt := 0; ; attempt++ {
+		n, err = c.Conn.Read(b)
+		if err == nil || n > 0 || attempt == maxTempRetries || !isTemporary(err) || !c.allow() {
+			if n > 0 && isTemporary(err) {
+				err = nil // The data is valid, the next Read reports the error again if it persists
+			}
+			return
+		}
+		time.Sleep(tempRetryDelay << attempt)
+	}
+}
+
+func (c retryConn) Write(b []byte) (n int, err error) {
+	for attempt := 0; ; attempt++ {
+		var written int
+		written, err = c.Conn.Write(b[n:])
+		n += written
+		if err == nil || attempt == maxTempRetries || !isTemporary(err) || !c.allow() {
+			return
+		}
+		time.Sleep(tempRetryDelay << attempt)
+	}
+}
+
+// Reports whether err is a transient socket error that the operation can be retried after.
+// Expired deadlines are not temporary, as retrying would fail the same way.
+func isTemporary(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && (netErr.Temporary() || netErr.Timeout())
+}
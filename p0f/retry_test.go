@@ -0,0 +1,108 @@
+package p0f
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// Fails the first failures reads and writes with err, then behaves like the wrapped conn.
+// Writes that fail may write part of the buffer first, as a real socket can.
+type flakyConn struct {
+	net.Conn
+	err      error
+	failures int
+	partial  int // Bytes written by a failing write
+}
+
+func (c *flakyConn) Read(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		n, _ := c.Conn.Write(b[:min(c.partial, len(b))])
+		return n, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func TestRetryConnRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		failures int
+		budget   int
+		wantErr  bool
+	}{
+		{"EINTR", syscall.EINTR, 1, 10, false},
+		{"EAGAIN", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.EAGAIN)}, maxTempRetries, 10, false},
+		{"temporary net.Error", tempError{}, 2, 10, false},
+		{"retries exhausted", syscall.EINTR, maxTempRetries + 1, 10, true},
+		{"budget exhausted", syscall.EINTR, 2, 1, true},
+		{"deadline exceeded", os.ErrDeadlineExceeded, 1, 10, true},
+		{"hard error", io.ErrUnexpectedEOF, 1, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				server.Write([]byte("p0f"))
+				server.Close()
+			}()
+			budget := newTokenBucket(1e-9, tt.budget)
+			conn := retryConn{&flakyConn{Conn: client, err: tt.err, failures: tt.failures}, budget.allow}
+
+			b := make([]byte, 3)
+			n, err := conn.Read(b)
+			if tt.wantErr {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Read error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil || string(b[:n]) != "p0f" {
+				t.Fatalf("Read = %q, %v, want %q", b[:n], err, "p0f")
+			}
+		})
+	}
+}
+
+func TestRetryConnWritePartial(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		received <- b
+	}()
+
+	want, _ := EncodeRequest(net.ParseIP("1.2.3.4"))
+	conn := retryConn{&flakyConn{Conn: client, err: syscall.EAGAIN, failures: 2, partial: 5}, (*tokenBucket)(nil).allow}
+	n, err := conn.Write(want[:])
+	if err != nil || n != len(want) {
+		t.Fatalf("Write = %d, %v, want %d, nil", n, err, len(want))
+	}
+	client.Close()
+
+	// The bytes written before each failure must not be written again
+	if got := <-received; !bytes.Equal(got, want[:]) {
+		t.Fatalf("received % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package p0f
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point in time snapshot of the counters kept by a P0f instance.
+type Stats struct {
+	Queries       uint64 `json:"queries"`       // Queries accepted into the request queue
+	Ok            uint64 `json:"ok"`            // Queries answered with a match
+	NoMatch       uint64 `json:"noMatch"`       // Queries p0f had no data for
+	BadQuery      uint64 `json:"badQuery"`      // Queries p0f rejected as malformed
+	Errors        uint64 `json:"errors"`        // Transport and protocol errors
+	QueueFull     uint64 `json:"queueFull"`     // Queries rejected because the queue was full
+	Reconnects    uint64 `json:"reconnects"`    // Successful reconnects to the p0f socket
+	Stale         uint64 `json:"stale"`         // Expired cache entries served because p0f was unavailable
+	Resyncs       uint64 `json:"resyncs"`       // Reconnects after responses were found misaligned
+	Retries       uint64 `json:"retries"`       // Retries allowed by the retry budget
+	RetriesDenied uint64 `json:"retriesDenied"` // Retries skipped because the retry budget was exhausted
+	Abandoned     uint64 `json:"abandoned"`     // Queries whose context was done before they completed
+	Timeouts      uint64 `json:"timeouts"`      // Reads and writes that failed with ErrTimeout
+	CacheHits     uint64 `json:"cacheHits"`     // Queries answered from the cache, see WithCache
+	CacheMisses   uint64 `json:"cacheMisses"`   // Queries not found in the cache, or expired
+	CacheEntries  int    `json:"cacheEntries"`  // Responses currently cached
+	QueueLen      int    `json:"queueLen"`      // Requests currently waiting in the queue
+	QueueCap      int    `json:"queueCap"`      // Capacity of the queue
+
+	// Moving average of the time between writing a request to p0f and completing it
+	RoundTrip time.Duration `json:"roundTripNs"`
+
+	// Distribution of the same times, for percentiles
+	RoundTrips Histogram `json:"roundTrips"`
+}
+
+// Histogram is a snapshot of a distribution of durations, such as Stats.RoundTrips.
+type Histogram struct {
+	Buckets []HistogramBucket `json:"buckets"` // In increasing order of UpperBound
+	Count   uint64            `json:"count"`   // Durations observed
+	Sum     time.Duration     `json:"sumNs"`   // Sum of the durations observed
+}
+
+// HistogramBucket counts the durations of a Histogram within a range.
+type HistogramBucket struct {
+	// Durations counted are above the UpperBound of the previous bucket, and at most this one.
+	// The last bucket has no upper bound and has UpperBound set to math.MaxInt64.
+	UpperBound time.Duration `json:"upperBoundNs"`
+	Count      uint64        `json:"count"`
+}
+
+// Returns an estimate of the q quantile (0 to 1) of the durations in h, such as 0.99 for the p99:
+// the upper bound of the bucket it falls in. 0 is returned if h is empty.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(max(0, min(q, 1)) * float64(h.Count)))
+	var count uint64
+	for _, b := range h.Buckets {
+		count += b.Count
+		if count >= max(rank, 1) {
+			return b.UpperBound
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1].UpperBound
+}
+
+// Counters backing Stats. All fields are updated atomically.
+type stats struct {
+	queries       atomic.Uint64
+	ok            atomic.Uint64
+	noMatch       atomic.Uint64
+	badQuery      atomic.Uint64
+	errors        atomic.Uint64
+	queueFull     atomic.Uint64
+	reconnects    atomic.Uint64
+	stale         atomic.Uint64
+	resyncs       atomic.Uint64
+	retries       atomic.Uint64
+	retriesDenied atomic.Uint64
+	abandoned     atomic.Uint64
+	timeouts      atomic.Uint64
+	roundTrip     atomic.Int64 // nanoseconds, exponentially weighted
+	duration      histogram    // Time from enqueueing a request to completing it
+	roundTrips    histogram    // Time from writing a request to p0f to completing it
+}
+
+// Returns a snapshot of the counters of this instance.
+func (p *P0f) Stats() Stats {
+	s := Stats{
+		Queries:       p.stats.queries.Load(),
+		Ok:            p.stats.ok.Load(),
+		NoMatch:       p.stats.noMatch.Load(),
+		BadQuery:      p.stats.badQuery.Load(),
+		Errors:        p.stats.errors.Load(),
+		QueueFull:     p.stats.queueFull.Load(),
+		Reconnects:    p.stats.reconnects.Load(),
+		Stale:         p.stats.stale.Load(),
+		Resyncs:       p.stats.resyncs.Load(),
+		Retries:       p.stats.retries.Load(),
+		RetriesDenied: p.stats.retriesDenied.Load(),
+		Abandoned:     p.stats.abandoned.Load(),
+		Timeouts:      p.stats.timeouts.Load(),
+		QueueLen:      len(p.requestQueue),
+		QueueCap:      cap(p.requestQueue),
+		RoundTrip:     time.Duration(p.stats.roundTrip.Load()),
+		RoundTrips:    p.stats.roundTrips.snapshot(),
+	}
+	if p.cache != nil {
+		s.CacheHits, s.CacheMisses, s.CacheEntries = p.cache.hits.Load(), p.cache.misses.Load(), p.cache.len()
+	}
+	return s
+}
+
+// Handles a request for the Stats of the P0f instance as JSON (example: http://localhost:38749/stats)
+func (s *httpServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Has("p") {
+		enc.SetIndent("", " ")
+	}
+	if err := enc.Encode(s.p.Stats()); err != nil {
+		s.log.Printf("stats encode error: %s\n", err.Error())
+	}
+}
+
+// Estimates how long it takes to answer every request currently in the queue,
+// from the average round trip time and the number of requests p0f is sent at once.
+func (p *P0f) estimatedDrain() time.Duration {
+	concurrency := len(p.workers) * cap(p.workers[0].inflight)
+	return time.Duration(len(p.requestQueue)) * time.Duration(p.stats.roundTrip.Load()) / time.Duration(concurrency)
+}
+
+// Folds a round trip duration into the moving average, weighing it 1/8.
+func (s *stats) observeRoundTrip(d time.Duration) {
+	for {
+		old := s.roundTrip.Load()
+		avg := int64(d)
+		if old != 0 {
+			avg = old + (int64(d)-old)/8
+		}
+		if s.roundTrip.CompareAndSwap(old, avg) {
+			return
+		}
+	}
+}
+
+// Records the outcome of a completed request.
+func (s *stats) record(err error) {
+	switch err {
+	case nil:
+		s.ok.Add(1)
+	case ErrNoMatch:
+		s.noMatch.Add(1)
+	case ErrBadQuery:
+		s.badQuery.Add(1)
+	default:
+		s.errors.Add(1)
+	}
+}
@@ -0,0 +1,123 @@
+package p0f
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+)
+
+// Profiles the default synthetic responses are picked from.
+var syntheticProfiles = []struct {
+	osName, osFlavor, httpName, httpFlavor, linkType string
+	distance                                         uint16
+	linkMtu                                          uint16
+}{
+	{"Linux", "3.11 and newer", "Chrome", "11 or newer", "Ethernet or modem", 12, 1500},
+	{"Windows", "NT kernel", "Firefox", "10.x or newer", "Ethernet or modem", 8, 1500},
+	{"Mac OS X", "10.x", "Safari", "5.1-6", "DSL", 14, 1492},
+	{"Linux", "2.2.x-3.x", "", "", "generic tunnel or VPN", 20, 1400},
+	{"iOS", "iPhone or iPad", "Safari", "", "Ethernet or modem", 10, 1500},
+	{"Linux", "2.6.x", "Android", "", "Ethernet or modem", 16, 1500},
+	{"FreeBSD", "9.x or newer", "", "", "Ethernet or modem", 6, 1500},
+}
+
+// Base unix time of the synthetic FirstSeen values (2024-01-01T00:00:00Z)
+const syntheticEpoch = 1704067200
+
+// Serves queries from synthetic data instead of a p0f socket, for testing systems
+// built against this package or its HTTP API without running p0f.
+// The socket file passed to New is not opened.
+//
+// If rules is nil, every address gets a match derived from a hash
+// of the address, so the same address always gets the same response.
+// Otherwise, addresses are looked up in rules (keyed by IP address string)
+// and addresses without a rule get no match.
+// The Ip, LinkClass and Flags fields of rule responses are ignored, those are
+// computed the same way as for p0f responses.
+func WithSynthetic(rules map[string]P0fResponse) Option {
+	return func(o *options) error {
+		var normalized map[string]P0fResponse
+		if rules != nil {
+			normalized = make(map[string]P0fResponse, len(rules))
+			for key, response := range rules {
+				ip := net.ParseIP(key)
+				if ip == nil {
+					return fmt.Errorf("synthetic rule %q is not an IP address", key)
+				}
+				normalized[ip.String()] = response
+			}
+		}
+		o.dial = func() (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveSyntheticConn(server, o.byteOrder, normalized)
+			return client, nil
+		}
+		return nil
+	}
+}
+
+// Speaks the p0f API on conn, answering each query from rules or syntheticResponse.
+func serveSyntheticConn(conn net.Conn, order binary.ByteOrder, rules map[string]P0fResponse) {
+	defer conn.Close()
+	buffer := make([]byte, RequestSize)
+	for {
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return
+		}
+		ip, err := decodeRequest(order, buffer)
+		var frame []byte
+		switch {
+		case err != nil:
+			frame = encodeResponse(order, resultBadQuery, P0fResponse{})
+		case rules == nil:
+			frame = encodeResponse(order, resultOk, syntheticResponse(ip))
+		default:
+			if response, ok := rules[ip.String()]; ok {
+				frame = encodeResponse(order, resultOk, response)
+			} else {
+				frame = encodeResponse(order, resultNoMatch, P0fResponse{})
+			}
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// Returns the deterministic synthetic response for ip.
+func syntheticResponse(ip net.IP) P0fResponse {
+	h := fnv.New32a()
+	h.Write(ip.To16())
+	sum := h.Sum32()
+
+	profile := syntheticProfiles[sum%uint32(len(syntheticProfiles))]
+	firstSeen := syntheticEpoch + sum%(365*24*3600)
+	response := P0fResponse{
+		FirstSeen:  firstSeen,
+		LastSeen:   firstSeen + sum%(30*24*3600),
+		TotalCount: 1 + sum%500,
+		UptimeMin:  sum % (90 * 24 * 60),
+		UpModDays:  49,
+		Distance:   profile.distance,
+		LinkMtu:    profile.linkMtu,
+		OsName:     syntheticString(profile.osName),
+		OsFlavor:   syntheticString(profile.osFlavor),
+		HttpName:   syntheticString(profile.httpName),
+		HttpFlavor: syntheticString(profile.httpFlavor),
+		LinkType:   syntheticString(profile.linkType),
+		Language:   syntheticString("English"),
+	}
+	if sum&0x100 != 0 {
+		response.OsMatchQ = matchFuzzy
+	}
+	return response
+}
+
+func syntheticString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,62 @@
+package p0f
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestWithSyntheticHashed(t *testing.T) {
+	p, err := New("", WithSynthetic(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	for _, ip := range []string{"192.0.2.1", "198.51.100.7", "2001:db8::1"} {
+		want := syntheticResponse(net.ParseIP(ip))
+		for range 2 {
+			r, err := p.Query(net.ParseIP(ip))
+			if err != nil {
+				t.Fatalf("Query(%q) error = %v", ip, err)
+			}
+			if r.FirstSeen != want.FirstSeen || *r.OsName != *want.OsName || r.LinkClass != classifyLinkType(want.LinkType) {
+				t.Errorf("Query(%q) = %+v, want %+v", ip, r, want)
+			}
+		}
+	}
+}
+
+func TestWithSyntheticRules(t *testing.T) {
+	p, err := New("", WithSynthetic(map[string]P0fResponse{
+		"::ffff:192.0.2.1": {
+			Ip:        "203.0.113.1",
+			OsName:    syntheticString("Linux"),
+			LinkType:  syntheticString("generic tunnel or VPN"),
+			LinkClass: LinkWifi,
+			Flags:     []string{FlagNAT},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	r, err := p.Query(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ip != "192.0.2.1" || r.OsName == nil || *r.OsName != "Linux" {
+		t.Errorf("Query(192.0.2.1) = %+v, want the rule for ::ffff:192.0.2.1", r)
+	}
+	if r.LinkClass != LinkTunnel || len(r.Flags) != 1 || r.Flags[0] != FlagLikelyVPN {
+		t.Errorf("LinkClass and Flags = %q, %v, want them computed from the rule", r.LinkClass, r.Flags)
+	}
+	if _, err := p.Query(net.ParseIP("192.0.2.2")); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("Query(192.0.2.2) error = %v, want %v", err, ErrNoMatch)
+	}
+
+	if _, err := New("", WithSynthetic(map[string]P0fResponse{"example.com": {}})); err == nil {
+		t.Error("New with a rule that is not an IP address succeeded")
+	}
+}
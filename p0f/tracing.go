@@ -0,0 +1,64 @@
+package p0f
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Tracer starts the spans of queries made with WithTracer. It is meant to be implemented
+// by a small adapter to a tracing library, such as one wrapping an OpenTelemetry trace.Tracer
+// and its spans, so this package does not depend on one.
+type Tracer interface {
+	// Starts a span named name as a child of the span in ctx, if any,
+	// returning a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// Sets an attribute of the span. value is a string or a bool.
+	SetAttribute(key string, value any)
+	// Marks the span as failed with err.
+	RecordError(err error)
+	End()
+}
+
+// Reports the outcome of a traced query, see traceQuery.
+type endSpanFunc func(response P0fResponse, cached bool, err error)
+
+func endNoSpan(P0fResponse, bool, error) {}
+
+// Starts a "p0f.query" span for a query of ip if WithTracer is used, with the p0f.ip attribute.
+// The returned function ends it, setting the p0f.result ("ok", "nomatch", "badquery" or "error"),
+// p0f.cached and p0f.os_name attributes. Errors other than no match are recorded on the span.
+func (p *P0f) traceQuery(ctx context.Context, ip net.IP) (context.Context, endSpanFunc) {
+	if p.opts.tracer == nil {
+		return ctx, endNoSpan
+	}
+	ctx, span := p.opts.tracer.Start(ctx, "p0f.query")
+	if p.opts.anonymizeIP {
+		ip = AnonymizeIP(ip)
+	}
+	span.SetAttribute("p0f.ip", ip.String())
+	return ctx, func(response P0fResponse, cached bool, err error) {
+		result := "error"
+		switch {
+		case err == nil:
+			result = "ok"
+		case errors.Is(err, ErrNoMatch):
+			result = "nomatch"
+		case errors.Is(err, ErrBadQuery):
+			result = "badquery"
+		}
+		span.SetAttribute("p0f.result", result)
+		span.SetAttribute("p0f.cached", cached)
+		if response.OsName != nil {
+			span.SetAttribute("p0f.os_name", *response.OsName)
+		}
+		if result == "error" || result == "badquery" {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
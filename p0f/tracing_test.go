@@ -0,0 +1,67 @@
+package p0f
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name   string
+	parent context.Context
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &testSpan{name: name, parent: ctx, attrs: map[string]any{}}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *testSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+func (s *testSpan) RecordError(err error)              { s.err = err }
+func (s *testSpan) End()                               { s.ended = true }
+
+func TestQueryTracing(t *testing.T) {
+	tracer := &testTracer{}
+	p, err := New("", WithSynthetic(map[string]P0fResponse{"192.0.2.1": {OsName: syntheticString("Linux")}}), WithTracer(tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	type parentKey struct{}
+	parent := context.WithValue(context.Background(), parentKey{}, true)
+	p.QueryContext(parent, net.ParseIP("192.0.2.1"))
+	p.QueryContext(parent, net.ParseIP("192.0.2.2"))
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(tracer.spans))
+	}
+	for i, want := range []map[string]any{
+		{"p0f.ip": "192.0.2.1", "p0f.result": "ok", "p0f.cached": false, "p0f.os_name": "Linux"},
+		{"p0f.ip": "192.0.2.2", "p0f.result": "nomatch", "p0f.cached": false},
+	} {
+		span := tracer.spans[i]
+		if span.name != "p0f.query" || !span.ended || span.err != nil || span.parent.Value(parentKey{}) == nil {
+			t.Errorf("span %d = %+v, want an ended p0f.query child span without error", i, span)
+		}
+		for key, value := range want {
+			if span.attrs[key] != value {
+				t.Errorf("span %d %s = %v, want %v", i, key, span.attrs[key], value)
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "github.com/bluemods/p0f-go/p0f"
+
+// SIGUSR1 and SIGUSR2 are not available on this platform.
+func handleSignals(p *p0f.P0f) {}
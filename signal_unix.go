@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bluemods/p0f-go/p0f"
+)
+
+// Installs the operational signal handlers:
+//
+//	SIGUSR1 logs the current p0f Stats
+//	SIGUSR2 forces a reconnect to the p0f socket
+func handleSignals(p *p0f.P0f) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range c {
+			switch sig {
+			case syscall.SIGUSR1:
+				log.Printf("stats: %+v\n", p.Stats())
+			case syscall.SIGUSR2:
+				if err := p.Reconnect(); err != nil {
+					log.Printf("reconnect failed: %s\n", err.Error())
+				} else {
+					log.Println("reconnected to p0f")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, which takes precedence over the build info embedded by the go command:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.revision=$(git rev-parse HEAD)"
+var (
+	version  string
+	revision string
+)
+
+// Returns the version of this build for -version, such as
+// "p0f-go v1.2.0 (revision 1a2b3c4, 2026-01-02T15:04:05Z) go1.23.0".
+func versionString() string {
+	info, _ := debug.ReadBuildInfo()
+	return formatVersion(info)
+}
+
+// Formats the version of versionString from version and revision, and from info if not nil.
+func formatVersion(info *debug.BuildInfo) string {
+	v, rev, built, modified := version, revision, "", false
+	if info != nil {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if revision != "" {
+				break // The commit time and state are those of the embedded revision
+			}
+			switch setting.Key {
+			case "vcs.revision":
+				rev = setting.Value
+			case "vcs.time":
+				built = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	s := "p0f-go " + v
+	if rev != "" {
+		if modified {
+			rev += "-dirty"
+		}
+		s += " (revision " + rev
+		if built != "" {
+			s += ", " + built
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s %s", s, runtime.Version())
+}